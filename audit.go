@@ -0,0 +1,317 @@
+package keyman
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditEntry records one management operation. Target is the address of
+// a key, or the name of an org or pool; Before and After are JSON.
+type AuditEntry struct {
+	ID        string `json:"id"`
+	Time      int64  `json:"time"`
+	Operator  string `json:"operator"`
+	Action    string `json:"action"`
+	Target    string `json:"target"`
+	Before    string `json:"before,omitempty"`
+	After     string `json:"after,omitempty"`
+	RequestID string `json:"request_id"`
+	IP        string `json:"ip"`
+}
+
+// the state of a key as audited
+type keyState struct {
+	Name   string `json:"name"`
+	Number int64  `json:"number"`
+	Sec    int64  `json:"sec"`
+}
+
+func (keyman *Keyman) getKeyState(redisConn redis.Conn, key string) (*keyState, error) {
+	redisConn.Send("HGET", keyman.rkey("keys"), keyman.keyAddPre(key))
+	redisConn.Send("GET", keyman.rkey(keyman.keyAddPre(key)))
+	redisConn.Send("TTL", keyman.rkey(keyman.keyAddPre(key)))
+	redisConn.Flush()
+
+	state := new(keyState)
+	name, err := redis.String(redisConn.Receive())
+	if err == redis.ErrNil {
+		redisConn.Receive()
+		redisConn.Receive()
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state.Name = name
+	state.Number, err = redis.Int64(redisConn.Receive())
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	state.Sec, err = redis.Int64(redisConn.Receive())
+	if err != nil {
+		return nil, err
+	}
+	if state.Sec < 0 {
+		state.Sec = 0
+	}
+	return state, nil
+}
+
+func requestID(c *gin.Context) string {
+	id := c.GetHeader("X-Request-Id")
+	if id == "" {
+		id = genLeaseID()
+		c.Header("X-Request-Id", id)
+	}
+	return id
+}
+
+func auditValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// the XADD of a management operation to the "audit" stream, trimmed to
+// about AuditMaxLen entries when it is set
+func (keyman *Keyman) auditArgs(c *gin.Context, priv *ecdsa.PrivateKey, action, target string, before, after interface{}) redis.Args {
+	args := redis.Args{}.Add(keyman.rkey("audit"))
+	if keyman.AuditMaxLen > 0 {
+		args = args.Add("MAXLEN", "~", keyman.AuditMaxLen)
+	}
+	return args.Add("*",
+		"time", time.Now().Unix(),
+		"operator", manID(priv),
+		"action", action,
+		"target", target,
+		"before", auditValue(before),
+		"after", auditValue(after),
+		"request_id", requestID(c),
+		"ip", c.ClientIP())
+}
+
+// audit appends a management operation to the "audit" stream.
+func (keyman *Keyman) audit(c *gin.Context, priv *ecdsa.PrivateKey, action, target string, before, after interface{}) error {
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	_, err := redisConn.Do("XADD", keyman.auditArgs(c, priv, action, target, before, after)...)
+	return err
+}
+
+// execAudited runs the commands queued with Send after a MULTI on
+// redisConn along with the audit of them, so neither is done without the
+// other.
+func (keyman *Keyman) execAudited(redisConn redis.Conn, c *gin.Context, priv *ecdsa.PrivateKey, action, target string, before, after interface{}) error {
+	redisConn.Send("XADD", keyman.auditArgs(c, priv, action, target, before, after)...)
+	replies, err := redis.Values(redisConn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// KEYS are counters to increment by ARGV[1], then the audit stream and
+// ARGV[2] its MAXLEN, 0 for none. ARGV[3] to ARGV[8] are the time,
+// operator, action, target, request id and ip of the entry, ARGV[9] and
+// ARGV[10] the JSON of before and after, to which the value of each
+// counter is added under its name in ARGV[11] on. Nothing is written
+// unless every counter can be incremented.
+var auditIncrScript = redis.NewScript(-1, `
+local n = #KEYS - 1
+local count = tonumber(ARGV[1])
+for i = 1, n do
+	local v = redis.call('GET', KEYS[i])
+	if v and not string.match(v, '^-?%d+$') then
+		return redis.error_reply('counter is not an integer')
+	end
+end
+local before = cjson.decode(ARGV[9])
+local after = cjson.decode(ARGV[10])
+local ret = {}
+for i = 1, n do
+	local v = redis.call('INCRBY', KEYS[i], count)
+	before[ARGV[10 + i]] = v - count
+	after[ARGV[10 + i]] = v
+	ret[i] = v
+end
+local args = {KEYS[n + 1]}
+if tonumber(ARGV[2]) > 0 then
+	table.insert(args, 'MAXLEN')
+	table.insert(args, '~')
+	table.insert(args, ARGV[2])
+end
+for _, v in ipairs({'*', 'time', ARGV[3], 'operator', ARGV[4], 'action', ARGV[5], 'target', ARGV[6],
+	'before', cjson.encode(before), 'after', cjson.encode(after), 'request_id', ARGV[7], 'ip', ARGV[8]}) do
+	table.insert(args, v)
+end
+redis.call('XADD', unpack(args))
+return ret
+`)
+
+// auditIncr adds count to the counters and audits it in one step, with
+// the value of each counter in before and after under its name in names.
+// It returns the counters after.
+func (keyman *Keyman) auditIncr(redisConn redis.Conn, c *gin.Context, priv *ecdsa.PrivateKey, action, target string,
+	count int64, counters, names []string, before, after gin.H) ([]int64, error) {
+	args := redis.Args{}.Add(len(counters) + 1)
+	for _, counter := range counters {
+		args = args.Add(counter)
+	}
+	args = args.Add(keyman.rkey("audit"), count, keyman.AuditMaxLen,
+		time.Now().Unix(), manID(priv), action, target, requestID(c), c.ClientIP(),
+		auditValue(before), auditValue(after))
+	for _, name := range names {
+		args = args.Add(name)
+	}
+	return redis.Int64s(auditIncrScript.Do(redisConn, args...))
+}
+
+// auditKey audits an operation on key, reporting a failure to write the
+// entry as the result of the request.
+func (keyman *Keyman) auditKey(c *gin.Context, priv *ecdsa.PrivateKey, action, key string, before, after interface{}) bool {
+	return keyman.auditTarget(c, priv, action, KeyToAddrStr(key), before, after)
+}
+
+func (keyman *Keyman) auditTarget(c *gin.Context, priv *ecdsa.PrivateKey, action, target string, before, after interface{}) bool {
+	err := keyman.audit(c, priv, action, target, before, after)
+	if err != nil {
+		keyman.renderError(c, err)
+		return false
+	}
+	return true
+}
+
+func parseAuditEntry(v interface{}) (*AuditEntry, error) {
+	values, err := redis.Values(v, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 2 {
+		return nil, errors.New("audit entry error")
+	}
+	id, err := redis.String(values[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := redis.StringMap(values[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	entry := &AuditEntry{
+		ID:        id,
+		Operator:  fields["operator"],
+		Action:    fields["action"],
+		Target:    fields["target"],
+		Before:    fields["before"],
+		After:     fields["after"],
+		RequestID: fields["request_id"],
+		IP:        fields["ip"],
+	}
+	entry.Time, _ = strconv.ParseInt(fields["time"], 10, 64)
+	return entry, nil
+}
+
+// GetAudit returns up to count entries, newest first, with an id below
+// before when it is set. Empty action and target match all.
+func (keyman *Keyman) GetAudit(before, action, target string, count int) ([]*AuditEntry, error) {
+	end := "+"
+	if before != "" {
+		end = "(" + before
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	var entries []*AuditEntry
+	for len(entries) < count {
+		values, err := redis.Values(redisConn.Do("XREVRANGE", keyman.rkey("audit"), end, "-", "COUNT", count))
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			entry, err := parseAuditEntry(v)
+			if err != nil {
+				return nil, err
+			}
+			end = "(" + entry.ID
+			if action != "" && entry.Action != action {
+				continue
+			}
+			if target != "" && entry.Target != target {
+				continue
+			}
+			entries = append(entries, entry)
+			if len(entries) == count {
+				break
+			}
+		}
+		if len(values) < count {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// the most entries a list call returns, a larger count is clamped to it
+const maxListCount = 1000
+
+// ListAudit lists the audit log. With format=jsonl the entries are
+// written one JSON object per line, for export.
+func (keyman *Keyman) ListAudit(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	count, err := strconv.Atoi(c.DefaultQuery("count", "100"))
+	if err != nil || count <= 0 {
+		keyman.renderError(c, badRequest("count error"))
+		return
+	}
+	if count > maxListCount {
+		count = maxListCount
+	}
+	target := c.Query("target")
+	if len(target) >= 70 {
+		// a key, entries hold its address
+		target = KeyToAddrStr(target)
+	}
+
+	entries, err := keyman.GetAudit(c.Query("before"), c.Query("action"), target, count)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	if strings.EqualFold(c.Query("format"), "jsonl") {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		enc := json.NewEncoder(c.Writer)
+		for _, entry := range entries {
+			enc.Encode(entry)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "ok",
+		"entries": entries,
+	})
+}
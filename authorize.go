@@ -0,0 +1,421 @@
+package keyman
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gomodule/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSignatureSkew = 5 * time.Minute
+
+// Credentials is what a caller presented: a key, a token, or a signature
+// made with the key over Timestamp, Nonce, Method, the route and
+// ContentHash, see SignRequest. Manager asks for Key to be checked as a
+// management key. Cert is a client certificate the TLS server verified,
+// see PeerCertificate, it stands for the key registered to it when no key
+// is sent.
+type Credentials struct {
+	Key       string
+	Token     string
+	Signature string
+	Timestamp string
+	Manager   bool
+	Cert      *x509.Certificate
+
+	// Nonce is used once by a signature, Method is that of the request
+	// and ContentHash the BodyHash of its body.
+	Nonce       string
+	Method      string
+	ContentHash string
+}
+
+// Identity is what Authorize knows about an allowed caller.
+type Identity struct {
+	Key       string
+	Address   string
+	Name      string
+	Remaining int64
+	Manager   bool
+	Quota     *Quota
+	Token     *TokenInfo
+}
+
+type requireOptions struct {
+	path      bool
+	quotaPath string
+	onlytime  bool
+	headers   bool
+	consume   bool
+}
+
+type RequireOption func(*requireOptions)
+
+// WithPathQuota also requires quota left on the request path.
+func WithPathQuota() RequireOption {
+	return func(o *requireOptions) {
+		o.path = true
+	}
+}
+
+// WithQuotaPath requires quota left on reqpath, for callers that meter a
+// route by a prefix of the request path.
+func WithQuotaPath(reqpath string) RequireOption {
+	return func(o *requireOptions) {
+		o.path = true
+		o.quotaPath = reqpath
+	}
+}
+
+// WithOnlyTime only requires the key not to be expired, like
+// IsKeyValidOnlytime.
+func WithOnlyTime() RequireOption {
+	return func(o *requireOptions) {
+		o.onlytime = true
+	}
+}
+
+// WithQuotaHeaders reports the quota in the response headers.
+func WithQuotaHeaders() RequireOption {
+	return func(o *requireOptions) {
+		o.headers = true
+	}
+}
+
+// WithConsume debits one unit before the handler runs.
+func WithConsume() RequireOption {
+	return func(o *requireOptions) {
+		o.consume = true
+	}
+}
+
+// WithoutConsume turns off a WithConsume given before it.
+func WithoutConsume() RequireOption {
+	return func(o *requireOptions) {
+		o.consume = false
+	}
+}
+
+// Decision is the outcome of Authorize. A denied request has Allow false
+// and the reason in Reason and Err; the error of Authorize is kept for
+// failures of the store itself.
+type Decision struct {
+	Allow    bool
+	Reason   string
+	Err      *Error
+	Identity *Identity
+}
+
+type identityCtxKey struct{}
+
+// NewContext returns a copy of ctx that carries id.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityCtxKey{}, id)
+}
+
+// FromContext returns the identity stored by NewContext.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityCtxKey{}).(*Identity)
+	return id, ok
+}
+
+func deny(err error) Decision {
+	e := AsError(err)
+	return Decision{Reason: e.Message, Err: e}
+}
+
+func (keyman *Keyman) CheckManKey(key string) (*ecdsa.PrivateKey, error) {
+	return keyman.checkManKey(context.Background(), key)
+}
+
+func (keyman *Keyman) checkManKey(ctx context.Context, key string) (priv *ecdsa.PrivateKey, err error) {
+	ctx, span := keyman.startSpan(ctx, "keyman.CheckManKey")
+	defer func() {
+		if err == nil && priv == nil {
+			endSpan(span, ErrAccessDenied)
+			return
+		}
+		endSpan(span, err)
+	}()
+
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("mkeys"), key))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if isExist == 0 {
+		return nil, nil
+	}
+	priv = keyman.StrToPriv(key)
+	return priv, nil
+}
+
+// Authorize runs the key, token or management key checks for a request
+// to route, without reference to any web framework.
+func (keyman *Keyman) Authorize(ctx context.Context, cred Credentials, route string, opts ...RequireOption) (Decision, error) {
+	ctx, span := keyman.startSpan(ctx, "keyman.Authorize",
+		attribute.String("keyman.route", route),
+		attribute.String("keyman.credentials", credentialKind(cred)))
+	d, err := keyman.authorize(ctx, cred, route, opts...)
+	endDecisionSpan(span, d, err)
+	if keyman.Observer != nil {
+		keyman.Observer.Decision(d, err)
+	}
+	return d, err
+}
+
+// AuthorizeIdentity runs the quota checks of Authorize again for an
+// identity it allowed, without the credentials, for callers that meter
+// each message of a stream opened with a one-time signature.
+func (keyman *Keyman) AuthorizeIdentity(ctx context.Context, id *Identity, route string, opts ...RequireOption) (Decision, error) {
+	if err := ctx.Err(); err != nil {
+		return Decision{}, err
+	}
+	if id.Manager {
+		return Decision{Allow: true, Identity: id}, nil
+	}
+	o := new(requireOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+	d, err := keyman.authorizeQuota(ctx, id.Key, id.Token, route, o)
+	if keyman.Observer != nil {
+		keyman.Observer.Decision(d, err)
+	}
+	return d, err
+}
+
+func (keyman *Keyman) authorize(ctx context.Context, cred Credentials, route string, opts ...RequireOption) (Decision, error) {
+	if err := ctx.Err(); err != nil {
+		return Decision{}, err
+	}
+	o := new(requireOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	switch {
+	case cred.Manager:
+		return keyman.authorizeManager(ctx, cred.Key)
+	case cred.Token != "":
+		return keyman.authorizeToken(ctx, cred.Token, route, o)
+	case cred.Signature != "":
+		return keyman.authorizeSignature(ctx, cred, route, o)
+	case cred.Key == "" && cred.Cert != nil:
+		return keyman.authorizeCert(ctx, cred.Cert, route, o)
+	default:
+		return keyman.authorizeKey(ctx, cred.Key, route, o)
+	}
+}
+
+func (keyman *Keyman) authorizeManager(ctx context.Context, key string) (Decision, error) {
+	priv, err := keyman.checkManKey(ctx, key)
+	if err != nil {
+		return Decision{}, err
+	}
+	if priv == nil {
+		return deny(ErrAccessDenied), nil
+	}
+	return Decision{
+		Allow: true,
+		Identity: &Identity{
+			Key:     key,
+			Address: manID(priv),
+			Manager: true,
+		},
+	}, nil
+}
+
+func (keyman *Keyman) authorizeToken(ctx context.Context, token, route string, o *requireOptions) (Decision, error) {
+	tokeninfo, err := keyman.lookupToken(ctx, token, route)
+	if err != nil {
+		return deny(err), nil
+	}
+	return keyman.authorizeQuota(ctx, tokeninfo.Key, tokeninfo, route, o)
+}
+
+func (keyman *Keyman) authorizeKey(ctx context.Context, key, route string, o *requireOptions) (Decision, error) {
+	return keyman.authorizeQuota(ctx, key, nil, route, o)
+}
+
+// authorizeQuota checks and meters the quota of key, which token stands
+// for when it is not nil.
+func (keyman *Keyman) authorizeQuota(ctx context.Context, key string, token *TokenInfo, route string, o *requireOptions) (Decision, error) {
+	reqpath := ""
+	if o.path {
+		reqpath = route
+		if o.quotaPath != "" {
+			reqpath = o.quotaPath
+		}
+	}
+
+	q, err := keyman.getQuota(ctx, reqpath, key)
+	if err != nil {
+		return Decision{}, err
+	}
+	if o.onlytime {
+		err = keyman.checkQuotaOnlytime(q)
+	} else {
+		err = keyman.checkQuota(ctx, q)
+	}
+	if err != nil {
+		return deny(err), nil
+	}
+
+	if o.consume {
+		tokenID := ""
+		if token != nil {
+			tokenID = token.ID
+		}
+		err = keyman.consume(ctx, reqpath, key, tokenID, 1)
+		if err != nil {
+			return deny(err), nil
+		}
+	}
+
+	return Decision{
+		Allow: true,
+		Identity: &Identity{
+			Key:       key,
+			Address:   KeyToAddrStr(key),
+			Name:      q.Name,
+			Remaining: q.remaining(),
+			Quota:     q,
+			Token:     token,
+		},
+	}, nil
+}
+
+const maxNonceLen = 64
+
+// BodyHash is the hex SHA-256 of a request body, as signed.
+func BodyHash(body []byte) string {
+	h := sha256.Sum256(body)
+	return hex.EncodeToString(h[:])
+}
+
+func signatureHash(cred Credentials, route string) []byte {
+	h := sha256.Sum256([]byte(strings.Join([]string{cred.Timestamp, cred.Nonce, cred.Method, route, cred.ContentHash}, "\n")))
+	return h[:]
+}
+
+// SignRequest signs a request with method and body to route at t with
+// priv, for callers that authenticate with a signature instead of sending
+// the key. The credentials it returns go in the signature, timestamp,
+// nonce and content-sha256 headers, and are good for one request.
+func SignRequest(priv *ecdsa.PrivateKey, method, route string, body []byte, t time.Time) (Credentials, error) {
+	cred := Credentials{
+		Timestamp:   strconv.FormatInt(t.Unix(), 10),
+		Nonce:       genLeaseID(),
+		Method:      method,
+		ContentHash: BodyHash(body),
+	}
+	sig, err := crypto.Sign(signatureHash(cred, route), priv)
+	if err != nil {
+		return Credentials{}, err
+	}
+	cred.Signature = fmt.Sprintf("%x", sig)
+	return cred, nil
+}
+
+func (keyman *Keyman) signatureSkew() time.Duration {
+	if keyman.SignatureSkew <= 0 {
+		return defaultSignatureSkew
+	}
+	return keyman.SignatureSkew
+}
+
+// keyByAddr returns the key of a key address, "" if there is none. Keys
+// added before keyaddrs was kept are filled in on the first miss.
+func (keyman *Keyman) keyByAddr(ctx context.Context, addr string) (string, error) {
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+	key, err := redis.String(redisConn.Do("HGET", keyman.rkey("keyaddrs"), addr))
+	if err != redis.ErrNil {
+		return key, err
+	}
+
+	keyman.keyaddrsMu.Lock()
+	defer keyman.keyaddrsMu.Unlock()
+	if keyman.keyaddrsFilled {
+		return "", nil
+	}
+	keys, err := redis.Strings(redisConn.Do("HKEYS", keyman.rkey("keys")))
+	if err != nil {
+		return "", err
+	}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, keyman.Keypre) {
+			continue
+		}
+		k = keyman.keyDelPre(k)
+		_, err = redisConn.Do("HSETNX", keyman.rkey("keyaddrs"), KeyToAddrStr(k), k)
+		if err != nil {
+			return "", err
+		}
+		if KeyToAddrStr(k) == addr {
+			key = k
+		}
+	}
+	keyman.keyaddrsFilled = true
+	return key, nil
+}
+
+func (keyman *Keyman) authorizeSignature(ctx context.Context, cred Credentials, route string, o *requireOptions) (Decision, error) {
+	sec, err := strconv.ParseInt(cred.Timestamp, 10, 64)
+	if err != nil {
+		return deny(ErrSignatureInvalid), nil
+	}
+	skew := time.Since(time.Unix(sec, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > keyman.signatureSkew() {
+		return deny(ErrSignatureExpired), nil
+	}
+	if cred.Nonce == "" || len(cred.Nonce) > maxNonceLen {
+		return deny(ErrSignatureInvalid), nil
+	}
+
+	sig, err := hex.DecodeString(cred.Signature)
+	if err != nil {
+		return deny(ErrSignatureInvalid), nil
+	}
+	pub, err := crypto.SigToPub(signatureHash(cred, route), sig)
+	if err != nil {
+		return deny(ErrSignatureInvalid), nil
+	}
+	addr := crypto.PubkeyToAddress(*pub)
+	addrStr := AddrToStr(&addr)
+
+	key, err := keyman.keyByAddr(ctx, addrStr)
+	if err != nil {
+		return Decision{}, err
+	}
+	if key == "" {
+		return deny(ErrAccessDenied), nil
+	}
+
+	// a nonce is kept as long as its timestamp is in the window
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+	_, err = redis.String(redisConn.Do("SET", keyman.rkey("signonce-"+addrStr+"-"+cred.Nonce), 1,
+		"NX", "PX", int64(2*keyman.signatureSkew()/time.Millisecond)))
+	if err == redis.ErrNil {
+		return deny(ErrSignatureReplayed), nil
+	} else if err != nil {
+		return Decision{}, err
+	}
+	return keyman.authorizeKey(ctx, key, route, o)
+}
@@ -0,0 +1,206 @@
+package keyman
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"strings"
+)
+
+// client certificates registered in "certkeys", by fingerprint or by
+// subject, map to the key they authenticate
+const (
+	certFingerprintPre = "sha256:"
+	certSubjectPre     = "subject:"
+)
+
+// CertFingerprint is the SHA-256 of the DER certificate, in hex.
+func CertFingerprint(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(h[:])
+}
+
+// PeerCertificate returns the client certificate of a connection once the
+// TLS server has verified it against its client CAs, nil otherwise.
+func PeerCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// the key a client certificate is registered to, by fingerprint first
+func (keyman *Keyman) certKey(ctx context.Context, cert *x509.Certificate) (string, error) {
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+	values, err := redis.Values(redisConn.Do("HMGET", keyman.rkey("certkeys"),
+		certFingerprintPre+CertFingerprint(cert), certSubjectPre+cert.Subject.String()))
+	if err != nil {
+		return "", err
+	}
+	for _, v := range values {
+		if v != nil {
+			return redis.String(v, nil)
+		}
+	}
+	return "", nil
+}
+
+func (keyman *Keyman) authorizeCert(ctx context.Context, cert *x509.Certificate, route string, o *requireOptions) (Decision, error) {
+	key, err := keyman.certKey(ctx, cert)
+	if err != nil {
+		return Decision{}, err
+	}
+	if key == "" {
+		return deny(ErrAccessDenied), nil
+	}
+	return keyman.authorizeKey(ctx, key, route, o)
+}
+
+// the certkeys field of the fingerprint or subject in a request
+func certField(c *gin.Context) (string, error) {
+	fingerprint := strings.ToLower(strings.Replace(c.Request.FormValue("fingerprint"), ":", "", -1))
+	subject := c.Request.FormValue("subject")
+	switch {
+	case fingerprint != "" && subject != "":
+		return "", badRequest("fingerprint or subject, not both")
+	case fingerprint != "":
+		b, err := hex.DecodeString(fingerprint)
+		if err != nil || len(b) != sha256.Size {
+			return "", badRequest("fingerprint error")
+		}
+		return certFingerprintPre + fingerprint, nil
+	case subject != "":
+		return certSubjectPre + subject, nil
+	}
+	return "", badRequest("require fingerprint or subject")
+}
+
+// SetCertKey registers a client certificate, by fingerprint or by subject,
+// to authenticate as key.
+func (keyman *Keyman) SetCertKey(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	key := c.Request.FormValue("key")
+	if strings.EqualFold("", key) {
+		keyman.renderError(c, badRequest("require key"))
+		return
+	}
+	field, err := certField(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("keys"), keyman.keyAddPre(key)))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if isExist == 0 {
+		keyman.renderError(c, ErrKeyNotFound)
+		return
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HSET", keyman.rkey("certkeys"), field, key)
+	err = keyman.execAudited(redisConn, c, priv, "setcertkey", KeyToAddrStr(key), nil, gin.H{"cert": field})
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"cert":   field,
+	})
+}
+
+func (keyman *Keyman) DelCertKey(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	field, err := certField(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("certkeys"), field))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if isExist == 0 {
+		keyman.renderError(c, &Error{"CERT_NOT_FOUND", http.StatusNotFound, "cert not exist"})
+		return
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HDEL", keyman.rkey("certkeys"), field)
+	err = keyman.execAudited(redisConn, c, priv, "delcertkey", field, nil, nil)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"cert":   field,
+	})
+}
+
+// ListCertKey lists the registered certificates with the address of
+// their key.
+func (keyman *Keyman) ListCertKey(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	values, err := redis.StringMap(redisConn.Do("HGETALL", keyman.rkey("certkeys")))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	certs := make(map[string]string, len(values))
+	for field, key := range values {
+		certs[field] = KeyToAddrStr(key)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"certs":  certs,
+	})
+}
@@ -0,0 +1,237 @@
+package keyman
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultLeaseTime = time.Minute
+
+// drop expired leases, then take a slot if one is free
+var acquireScript = redis.NewScript(1, `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return 1
+`)
+
+// push the expiry of a lease that is still held
+var renewScript = redis.NewScript(1, `
+if redis.call('ZSCORE', KEYS[1], ARGV[2]) == false then
+	return 0
+end
+redis.call('ZADD', KEYS[1], 'XX', ARGV[1], ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+func genConcurrentKey(path, key string) string {
+	if path == "" {
+		return "concurrent-" + key
+	}
+	return path + "-concurrent-" + key
+}
+
+func genLeaseID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+func (keyman *Keyman) leaseTime() time.Duration {
+	if keyman.LeaseTime <= 0 {
+		return defaultLeaseTime
+	}
+	return keyman.LeaseTime
+}
+
+func (keyman *Keyman) GetConcurrentLimit(key string) (int, error) {
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	limit, err := redis.Int(redisConn.Do("HGET", keyman.rkey("concurrent"), keyman.keyAddPre(key)))
+	if err == redis.ErrNil {
+		return keyman.MaxConcurrent, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return limit, nil
+}
+
+// AcquireConcurrent takes an in-flight slot for key, scoped to reqpath when
+// it is not empty. The returned lease must be passed to ReleaseConcurrent; an
+// empty lease means the key has no limit. A lease lapses after LeaseTime,
+// requests that may run longer hold it with HoldConcurrent.
+func (keyman *Keyman) AcquireConcurrent(reqpath, key string) (string, error) {
+	limit, err := keyman.GetConcurrentLimit(key)
+	if err != nil {
+		return "", err
+	}
+	if limit <= 0 {
+		return "", nil
+	}
+
+	lease := genLeaseID()
+	now := time.Now()
+	leaseTime := keyman.leaseTime()
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	ok, err := redis.Int(acquireScript.Do(redisConn,
+		keyman.rkey(genConcurrentKey(reqpath, key)),
+		now.UnixNano()/int64(time.Millisecond),
+		now.Add(leaseTime).UnixNano()/int64(time.Millisecond),
+		limit,
+		lease,
+		int64(leaseTime/time.Millisecond)))
+	if err != nil {
+		return "", err
+	}
+	if ok == 0 {
+		return "", ErrTooManyConcurrent
+	}
+	return lease, nil
+}
+
+// HoldConcurrent renews lease every third of LeaseTime until release is
+// called, which also releases the lease.
+func (keyman *Keyman) HoldConcurrent(reqpath, key, lease string) (release func()) {
+	if lease == "" {
+		return func() {}
+	}
+	leaseTime := keyman.leaseTime()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(leaseTime / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				// a failed renewal is tried again on the next tick
+				keyman.renewConcurrent(reqpath, key, lease, now, leaseTime)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		keyman.ReleaseConcurrent(reqpath, key, lease)
+	}
+}
+
+func (keyman *Keyman) renewConcurrent(reqpath, key, lease string, now time.Time, leaseTime time.Duration) error {
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	_, err := renewScript.Do(redisConn,
+		keyman.rkey(genConcurrentKey(reqpath, key)),
+		now.Add(leaseTime).UnixNano()/int64(time.Millisecond),
+		lease,
+		int64(leaseTime/time.Millisecond))
+	return err
+}
+
+func (keyman *Keyman) ReleaseConcurrent(reqpath, key, lease string) error {
+	if lease == "" {
+		return nil
+	}
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	_, err := redisConn.Do("ZREM", keyman.rkey(genConcurrentKey(reqpath, key)), lease)
+	return err
+}
+
+// ConcurrentLimit is middleware that caps the in-flight requests of the
+// identity set by a Require middleware before it, and aborts without one.
+// With byRoute the cap applies per route template.
+func (keyman *Keyman) ConcurrentLimit(byRoute bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := GetIdentity(c)
+		if !ok {
+			keyman.AbortError(c, ErrAccessDenied)
+			return
+		}
+		key := id.Key
+		reqpath := ""
+		if byRoute {
+			reqpath = c.FullPath()
+		}
+
+		lease, err := keyman.AcquireConcurrent(reqpath, key)
+		if err != nil {
+			keyman.AbortError(c, err)
+			return
+		}
+		release := keyman.HoldConcurrent(reqpath, key, lease)
+		defer release()
+
+		c.Next()
+	}
+}
+
+func (keyman *Keyman) SetConcurrent(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	key := c.Request.FormValue("key")
+	if strings.EqualFold("", key) {
+		keyman.renderError(c, badRequest("require key"))
+		return
+	}
+
+	limit := c.Request.FormValue("limit")
+	if strings.EqualFold("", limit) {
+		keyman.renderError(c, badRequest("require limit"))
+		return
+	}
+
+	limitInt, err := strconv.Atoi(limit)
+	if err != nil {
+		keyman.renderError(c, badRequest("limit error"))
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("keys"), keyman.keyAddPre(key)))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if isExist == 0 {
+		keyman.renderError(c, ErrKeyNotFound)
+		return
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HSET", keyman.rkey("concurrent"), keyman.keyAddPre(key), limitInt)
+	err = keyman.execAudited(redisConn, c, priv, "setconcurrent", KeyToAddrStr(key), nil, gin.H{"limit": limitInt})
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"key":    key,
+		"limit":  limitInt,
+	})
+}
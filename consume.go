@@ -0,0 +1,197 @@
+package keyman
+
+import (
+	"context"
+	"github.com/gomodule/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"strconv"
+)
+
+const (
+	debitRequired = "r"
+	debitOptional = "o"
+	debitFallback = "f"
+)
+
+// a counter of units drawn beyond the quota, up to allowance
+func debitOverdraft(allowance int64) string {
+	return "x:" + strconv.FormatInt(allowance, 10)
+}
+
+// KEYS are counters to debit, ARGV[i] says how KEYS[i] is treated: a
+// required counter must exist and a missing optional one is skipped.
+// Fallback and overdraft entries follow a counter and are tried in order
+// once it has run out; an overdraft counter counts up to its allowance.
+// The last ARGV is the number of units to debit from every level, nothing
+// is debited unless every level has that much left.
+//
+// Returns {code, remaining of KEYS[1]}, code is 0 on success, the index of
+// the failing counter, or minus the index of the fallback that was used.
+var debitScript = redis.NewScript(-1, `
+local target = {}
+local code = 0
+local i = 1
+local n = #KEYS
+local cost = tonumber(ARGV[n + 1])
+while i <= n do
+	local j = i + 1
+	while j <= n and (ARGV[j] == 'f' or string.sub(ARGV[j], 1, 2) == 'x:') do
+		j = j + 1
+	end
+	local v = redis.call('GET', KEYS[i])
+	if v == false then
+		if ARGV[i] ~= 'o' then
+			return {i, 0}
+		end
+	elseif tonumber(v) >= cost then
+		table.insert(target, {KEYS[i], -cost})
+	else
+		local pick = nil
+		for k = i + 1, j - 1 do
+			local fv = tonumber(redis.call('GET', KEYS[k]) or '0')
+			if ARGV[k] == 'f' then
+				if fv >= cost then
+					pick = {KEYS[k], -cost}
+				end
+			elseif fv + cost <= tonumber(string.sub(ARGV[k], 3)) then
+				pick = {KEYS[k], cost}
+			end
+			if pick ~= nil then
+				code = -k
+				break
+			end
+		end
+		if pick == nil then
+			return {i, 0}
+		end
+		table.insert(target, pick)
+	end
+	i = j
+end
+for _, t in ipairs(target) do
+	redis.call('INCRBY', t[1], t[2])
+end
+return {code, tonumber(redis.call('GET', KEYS[1]) or '0')}
+`)
+
+func (keyman *Keyman) debit(ctx context.Context, keys []string, modes []string, cost int64) (int, int64, error) {
+	args := redis.Args{}.Add(len(keys))
+	for _, k := range keys {
+		args = args.Add(k)
+	}
+	for _, m := range modes {
+		args = args.Add(m)
+	}
+	args = args.Add(cost)
+
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+	ret, err := redis.Int64s(debitScript.Do(redisConn, args...))
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(ret[0]), ret[1], nil
+}
+
+// Consume debits one unit from the key, its org and, when reqpath is not
+// empty, the path counters of both, all or nothing. A key that has run out
+// draws from its pool, then from its overdraft allowance.
+func (keyman *Keyman) Consume(reqpath, key string) error {
+	return keyman.ConsumeN(reqpath, key, 1)
+}
+
+// ConsumeN is Consume for calls that cost n units. The units are taken
+// from a single level, a key with less than n left draws all n from its
+// pool.
+func (keyman *Keyman) ConsumeN(reqpath, key string, n int64) error {
+	return keyman.consume(context.Background(), reqpath, key, "", n)
+}
+
+// ConsumeAs is ConsumeN for the identity Authorize returned, the
+// consumption stream records the token it used.
+func (keyman *Keyman) ConsumeAs(reqpath string, id *Identity, n int64) error {
+	tokenID := ""
+	if id.Token != nil {
+		tokenID = id.Token.ID
+	}
+	return keyman.consume(context.Background(), reqpath, id.Key, tokenID, n)
+}
+
+func (keyman *Keyman) consume(ctx context.Context, reqpath, key, tokenID string, n int64) (err error) {
+	if n <= 0 {
+		return badRequest("cost error")
+	}
+	ctx, span := keyman.startSpan(ctx, "keyman.Consume",
+		attribute.String("keyman.route", reqpath),
+		attribute.Int64("keyman.units", n))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	org, err := keyman.getKeyOrg(ctx, key)
+	if err != nil {
+		return err
+	}
+	pool, err := keyman.getKeyPool(ctx, key)
+	if err != nil {
+		return err
+	}
+	policy, err := keyman.getPolicy(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{keyman.rkey(keyman.keyAddPre(key))}
+	modes := []string{debitRequired}
+	if pool != "" {
+		keys = append(keys, keyman.rkey(keyman.keyAddPre(genPoolKey(pool))))
+		modes = append(modes, debitFallback)
+	}
+	overdraft := 0
+	if policy.Overdraft > 0 {
+		keys = append(keys, keyman.rkey(genOverdraftKey(key)))
+		modes = append(modes, debitOverdraft(policy.Overdraft))
+		overdraft = len(keys)
+	}
+	if reqpath != "" {
+		keys = append(keys, keyman.rkey(genCountKey(reqpath, key)))
+		modes = append(modes, debitRequired)
+	}
+	if org != "" {
+		keys = append(keys, keyman.rkey(keyman.keyAddPre(genOrgKey(org))))
+		modes = append(modes, debitRequired)
+		if reqpath != "" {
+			keys = append(keys, keyman.rkey(genCountKey(reqpath, genOrgKey(org))))
+			modes = append(modes, debitOptional)
+		}
+	}
+
+	code, remaining, err := keyman.debit(ctx, keys, modes, n)
+	if err != nil {
+		return err
+	}
+	if code > 0 {
+		keyman.recordConsume(reqpath, key, tokenID, n, ConsumeExhausted)
+		keyman.emit(Event{Type: EventQuotaExhausted, Key: key, Route: reqpath, Value: remaining})
+		return ErrQuotaExhausted
+	}
+	if keyman.Observer != nil {
+		keyman.Observer.Consumed(reqpath, n)
+	}
+
+	switch {
+	case overdraft > 0 && code == -overdraft:
+		keyman.recordConsume(reqpath, key, tokenID, n, ConsumeOverdraft)
+	case code < 0:
+		keyman.recordConsume(reqpath, key, tokenID, n, ConsumePool)
+	default:
+		keyman.recordConsume(reqpath, key, tokenID, n, ConsumeOK)
+	}
+
+	if overdraft > 0 && code == -overdraft {
+		keyman.emit(Event{Type: EventOverdraft, Key: key, Route: reqpath, Value: remaining})
+	} else if code == 0 {
+		keyman.checkBalance(policy, key, reqpath, remaining, n)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package keyman
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ConsumeOK        = "ok"
+	ConsumePool      = "pool"
+	ConsumeOverdraft = "overdraft"
+	ConsumeExhausted = "exhausted"
+)
+
+const (
+	consumeQueueSize = 10000
+	consumeBatch     = 100
+)
+
+// ConsumeRecord is one metered call as written to the consumption stream.
+// KeyID is the address of the key, TokenID that of the token used if any,
+// Outcome says where the units came from or ConsumeExhausted.
+type ConsumeRecord struct {
+	ID      string `json:"id,omitempty"`
+	KeyID   string `json:"key_id"`
+	Route   string `json:"route,omitempty"`
+	Units   int64  `json:"units"`
+	Time    int64  `json:"time"`
+	TokenID string `json:"token_id,omitempty"`
+	Outcome string `json:"outcome"`
+
+	// the key, its address is worked out by the writer
+	key string
+}
+
+type consumeSink struct {
+	queue   chan *ConsumeRecord
+	dropped int64
+}
+
+// TokenID names a token in records without giving it away.
+func TokenID(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:8])
+}
+
+// StartConsumeStream appends a ConsumeRecord to stream for every
+// consumption, trimmed to about maxLen entries when it is above 0, until
+// stop is called. Records are written by a goroutine of their own and
+// dropped when it falls behind, see ConsumeDropped; stop returns once the
+// records queued before it are written. With a Namespace the stream is
+// "<Namespace>:<stream>", the name keymstream consumers read.
+func (keyman *Keyman) StartConsumeStream(stream string, maxLen int64) (stop func()) {
+	sink := &consumeSink{queue: make(chan *ConsumeRecord, consumeQueueSize)}
+	keyman.consumeSink.Store(sink)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		write := func(rec *ConsumeRecord) {
+			batch := []*ConsumeRecord{rec}
+			for len(batch) < consumeBatch && len(sink.queue) > 0 {
+				batch = append(batch, <-sink.queue)
+			}
+			err := keyman.writeConsumeRecords(stream, maxLen, batch)
+			if err != nil {
+				atomic.AddInt64(&sink.dropped, int64(len(batch)))
+			}
+		}
+		for {
+			select {
+			case <-done:
+				// flush what was queued before stop
+				for len(sink.queue) > 0 {
+					write(<-sink.queue)
+				}
+				return
+			case rec := <-sink.queue:
+				write(rec)
+			}
+		}
+	}()
+
+	return func() {
+		once.Do(func() {
+			keyman.consumeSink.Store((*consumeSink)(nil))
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+// ConsumeDropped is the number of records the consumption stream lost
+// because the writer fell behind or Redis failed.
+func (keyman *Keyman) ConsumeDropped() int64 {
+	sink, _ := keyman.consumeSink.Load().(*consumeSink)
+	if sink == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&sink.dropped)
+}
+
+func (keyman *Keyman) recordConsume(reqpath, key, tokenID string, n int64, outcome string) {
+	sink, _ := keyman.consumeSink.Load().(*consumeSink)
+	if sink == nil {
+		return
+	}
+	rec := &ConsumeRecord{
+		Route:   reqpath,
+		Units:   n,
+		Time:    time.Now().UnixNano() / int64(time.Millisecond),
+		TokenID: tokenID,
+		Outcome: outcome,
+		key:     key,
+	}
+	select {
+	case sink.queue <- rec:
+	default:
+		atomic.AddInt64(&sink.dropped, 1)
+	}
+}
+
+func (keyman *Keyman) writeConsumeRecords(stream string, maxLen int64, batch []*ConsumeRecord) error {
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	for _, rec := range batch {
+		if rec.KeyID == "" {
+			rec.KeyID = KeyToAddrStr(rec.key)
+		}
+		args := redis.Args{}.Add(keyman.rkey(stream))
+		if maxLen > 0 {
+			args = args.Add("MAXLEN", "~", maxLen)
+		}
+		args = args.Add("*",
+			"key_id", rec.KeyID,
+			"route", rec.Route,
+			"units", rec.Units,
+			"time", rec.Time,
+			"token_id", rec.TokenID,
+			"outcome", rec.Outcome)
+		redisConn.Send("XADD", args...)
+	}
+	_, err := redisConn.Do("")
+	return err
+}
+
+// ParseConsumeRecord reads one entry of a stream reply, as returned by
+// XRANGE or XREADGROUP, into a ConsumeRecord.
+func ParseConsumeRecord(v interface{}) (*ConsumeRecord, error) {
+	values, err := redis.Values(v, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 2 {
+		return nil, errors.New("consume record error")
+	}
+	id, err := redis.String(values[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := redis.StringMap(values[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	rec := &ConsumeRecord{
+		ID:      id,
+		KeyID:   fields["key_id"],
+		Route:   fields["route"],
+		TokenID: fields["token_id"],
+		Outcome: fields["outcome"],
+	}
+	rec.Units, _ = strconv.ParseInt(fields["units"], 10, 64)
+	rec.Time, _ = strconv.ParseInt(fields["time"], 10, 64)
+	return rec, nil
+}
@@ -0,0 +1,214 @@
+package keyman
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Version is reported by diag, set it when building with
+// -ldflags "-X github.com/shellow/keyman.Version=v1.2.3".
+var Version = "dev"
+
+// the INFO fields diag reports, nothing that names a client
+var diagInfoFields = []string{
+	"redis_version", "redis_mode", "uptime_in_seconds",
+	"connected_clients", "blocked_clients",
+	"used_memory", "used_memory_human", "maxmemory",
+	"instantaneous_ops_per_sec", "evicted_keys", "expired_keys",
+	"role",
+}
+
+// Ping measures a round trip to Redis.
+func (keyman *Keyman) Ping(ctx context.Context) (time.Duration, error) {
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+	start := time.Now()
+	_, err := redisConn.Do("PING")
+	return time.Since(start), err
+}
+
+// CheckTokenStore stores and reads back a probe in the token cache.
+func (keyman *Keyman) CheckTokenStore() error {
+	if keyman.TokenCache == nil {
+		return errors.New("no token cache")
+	}
+	const probe = "keymem-probe"
+	err := keyman.TokenCache.SetWithExpire(probe, []byte{}, time.Second)
+	if err != nil {
+		return err
+	}
+	_, err = keyman.TokenCache.Get(probe)
+	keyman.TokenCache.Remove(probe)
+	return err
+}
+
+// DiagConfig is the configuration of a Keyman, without anything secret.
+type DiagConfig struct {
+	Keypre         string `json:"keypre"`
+	TokenTime      string `json:"token_time"`
+	MaxConcurrent  int    `json:"max_concurrent"`
+	LeaseTime      string `json:"lease_time"`
+	SignatureSkew  string `json:"signature_skew"`
+	LegacyErrors   bool   `json:"legacy_errors"`
+	ProblemJSON    bool   `json:"problem_json"`
+	AuditMaxLen    int64  `json:"audit_max_len"`
+	TransferMaxLen int64  `json:"transfer_max_len"`
+	WebhookRetries int    `json:"webhook_retries"`
+	WebhookDeadLen int64  `json:"webhook_dead_len"`
+	UsageMinute    string `json:"usage_minute"`
+	UsageHour      string `json:"usage_hour"`
+	UsageDay       string `json:"usage_day"`
+	Metrics        bool   `json:"metrics"`
+	Tracing        bool   `json:"tracing"`
+	ConsumeStream  bool   `json:"consume_stream"`
+}
+
+// DiagPool is the use of the Redis connection pool.
+type DiagPool struct {
+	Active       int    `json:"active"`
+	Idle         int    `json:"idle"`
+	MaxActive    int    `json:"max_active"`
+	MaxIdle      int    `json:"max_idle"`
+	WaitCount    int64  `json:"wait_count"`
+	WaitDuration string `json:"wait_duration"`
+}
+
+// Diag is what diag reports.
+type Diag struct {
+	Version string            `json:"version"`
+	Config  DiagConfig        `json:"config"`
+	Store   map[string]string `json:"store"`
+	Latency string            `json:"latency"`
+	Pool    DiagPool          `json:"pool"`
+	Keys    int64             `json:"keys"`
+	MKeys   int64             `json:"mkeys"`
+	Orgs    int64             `json:"orgs"`
+	Pools   int64             `json:"pools"`
+	Tokens  int               `json:"tokens"`
+
+	ConsumeDropped int64 `json:"consume_dropped"`
+}
+
+func (keyman *Keyman) diagConfig() DiagConfig {
+	sink, _ := keyman.consumeSink.Load().(*consumeSink)
+	return DiagConfig{
+		Keypre:         keyman.Keypre,
+		TokenTime:      keyman.TokenTime.String(),
+		MaxConcurrent:  keyman.MaxConcurrent,
+		LeaseTime:      keyman.leaseTime().String(),
+		SignatureSkew:  keyman.signatureSkew().String(),
+		LegacyErrors:   keyman.LegacyErrors,
+		ProblemJSON:    keyman.ProblemJSON,
+		AuditMaxLen:    keyman.AuditMaxLen,
+		TransferMaxLen: keyman.transferMaxLen(),
+		WebhookRetries: keyman.webhookRetries(),
+		WebhookDeadLen: keyman.webhookDeadLen(),
+		UsageMinute:    keyman.usageTTL(UsageMinute).String(),
+		UsageHour:      keyman.usageTTL(UsageHour).String(),
+		UsageDay:       keyman.usageTTL(UsageDay).String(),
+		Metrics:        keyman.Observer != nil,
+		Tracing:        keyman.Tracer != nil,
+		ConsumeStream:  sink != nil,
+	}
+}
+
+// the fields of an INFO reply
+func parseInfo(info string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		fields[line[:i]] = line[i+1:]
+	}
+	return fields
+}
+
+// GetDiag collects the state of Keyman and its store.
+func (keyman *Keyman) GetDiag(ctx context.Context) (*Diag, error) {
+	d := &Diag{
+		Version: Version,
+		Config:  keyman.diagConfig(),
+		Store:   make(map[string]string),
+	}
+
+	latency, err := keyman.Ping(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.Latency = latency.String()
+
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+	info, err := redis.String(redisConn.Do("INFO"))
+	if err != nil {
+		return nil, err
+	}
+	fields := parseInfo(info)
+	for _, f := range diagInfoFields {
+		if v, ok := fields[f]; ok {
+			d.Store[f] = v
+		}
+	}
+
+	redisConn.Send("HLEN", keyman.rkey("keys"))
+	redisConn.Send("HLEN", keyman.rkey("mkeys"))
+	redisConn.Send("HLEN", keyman.rkey("orgs"))
+	redisConn.Send("HLEN", keyman.rkey("pools"))
+	counts, err := redis.Int64s(redisConn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	if len(counts) == 4 {
+		d.Keys, d.MKeys, d.Orgs, d.Pools = counts[0], counts[1], counts[2], counts[3]
+	}
+
+	stats := keyman.RedisPool.Stats()
+	d.Pool = DiagPool{
+		Active:       stats.ActiveCount,
+		Idle:         stats.IdleCount,
+		MaxActive:    keyman.RedisPool.MaxActive,
+		MaxIdle:      keyman.RedisPool.MaxIdle,
+		WaitCount:    stats.WaitCount,
+		WaitDuration: stats.WaitDuration.String(),
+	}
+	if keyman.TokenCache != nil {
+		d.Tokens = keyman.TokenCache.Len(false)
+	}
+	d.ConsumeDropped = keyman.ConsumeDropped()
+	return d, nil
+}
+
+// Getdiag reports GetDiag to a manager.
+func (keyman *Keyman) Getdiag(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	d, err := keyman.GetDiag(c.Request.Context())
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"diag":   d,
+	})
+}
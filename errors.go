@@ -0,0 +1,132 @@
+package keyman
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Error is a failure with a stable machine readable Code and the HTTP
+// status it is reported with. Message is kept as the text older clients
+// match on.
+type Error struct {
+	Code    string
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+var (
+	ErrAccessDenied      = &Error{"ACCESS_DENIED", http.StatusUnauthorized, "access denied"}
+	ErrKeyNotFound       = &Error{"KEY_NOT_FOUND", http.StatusNotFound, "key not exist"}
+	ErrKeyInvalid        = &Error{"KEY_INVALID", http.StatusBadRequest, "too less"}
+	ErrKeyExpired        = &Error{"KEY_EXPIRED", http.StatusForbidden, "Expiry date"}
+	ErrQuotaExhausted    = &Error{"QUOTA_EXHAUSTED", http.StatusTooManyRequests, "Exceed quota of use"}
+	ErrOrgNotFound       = &Error{"ORG_NOT_FOUND", http.StatusNotFound, "org not exist"}
+	ErrOrgExpired        = &Error{"ORG_EXPIRED", http.StatusForbidden, "Org expiry date"}
+	ErrOrgQuotaExhausted = &Error{"ORG_QUOTA_EXHAUSTED", http.StatusTooManyRequests, "Org exceed quota of use"}
+	ErrPoolNotFound      = &Error{"POOL_NOT_FOUND", http.StatusNotFound, "pool not exist"}
+	ErrRouteDenied       = &Error{"ROUTE_DENIED", http.StatusForbidden, "route denied"}
+	ErrTokenInvalid      = &Error{"TOKEN_INVALID", http.StatusUnauthorized, "token not exist"}
+	ErrTokenMalformed    = &Error{"TOKEN_INVALID", http.StatusUnauthorized, "tooken error"}
+	ErrSignatureInvalid  = &Error{"SIGNATURE_INVALID", http.StatusUnauthorized, "signature error"}
+	ErrSignatureExpired  = &Error{"SIGNATURE_EXPIRED", http.StatusUnauthorized, "signature expired"}
+	ErrSignatureReplayed = &Error{"SIGNATURE_REPLAYED", http.StatusUnauthorized, "signature replayed"}
+	ErrTooManyConcurrent = &Error{"TOO_MANY_CONCURRENT", http.StatusTooManyRequests, "too many concurrent requests"}
+	ErrRateLimited       = &Error{"RATE_LIMITED", http.StatusTooManyRequests, "rate limit exceeded"}
+	ErrRouteNotFound     = &Error{"ROUTE_NOT_FOUND", http.StatusNotFound, "route not exist"}
+	ErrBodyTooLarge      = &Error{"BODY_TOO_LARGE", http.StatusRequestEntityTooLarge, "request body too large"}
+	ErrConsumeFailed     = &Error{"QUOTA_EXHAUSTED", http.StatusTooManyRequests, "dec count failed"}
+)
+
+func badRequest(message string) *Error {
+	return &Error{"BAD_REQUEST", http.StatusBadRequest, message}
+}
+
+func conflict(message string) *Error {
+	return &Error{"CONFLICT", http.StatusConflict, message}
+}
+
+func storeUnavailable(message string) *Error {
+	return &Error{"STORE_UNAVAILABLE", http.StatusServiceUnavailable, message}
+}
+
+func isStoreError(err error) bool {
+	var redisErr redis.Error
+	var netErr net.Error
+	return errors.As(err, &redisErr) || errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, redis.ErrPoolExhausted)
+}
+
+// AsError returns err as an *Error. Failures of the store are reported as
+// STORE_UNAVAILABLE with their text, anything else as INTERNAL_ERROR.
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	if isStoreError(err) {
+		return storeUnavailable(err.Error())
+	}
+	return &Error{"INTERNAL_ERROR", http.StatusInternalServerError, err.Error()}
+}
+
+// ErrorRenderer writes err to the response, it replaces the built in
+// shapes when set on Keyman.
+type ErrorRenderer func(c *gin.Context, err *Error)
+
+func (keyman *Keyman) wantProblem(accept string) bool {
+	return keyman.ProblemJSON || strings.Contains(accept, "application/problem+json")
+}
+
+// errorBody returns the status and body err is reported with: the legacy
+// 200 with status "error", the error status with code and message, or an
+// RFC 7807 problem.
+func (keyman *Keyman) errorBody(err *Error, accept, instance string) (int, string, interface{}) {
+	if keyman.LegacyErrors {
+		return http.StatusOK, "application/json; charset=utf-8", gin.H{
+			"status":  "error",
+			"message": err.Message,
+		}
+	}
+	if keyman.wantProblem(accept) {
+		return err.Status, "application/problem+json", gin.H{
+			"type":     "urn:keymem:error:" + strings.ToLower(err.Code),
+			"title":    http.StatusText(err.Status),
+			"status":   err.Status,
+			"detail":   err.Message,
+			"instance": instance,
+			"code":     err.Code,
+		}
+	}
+	return err.Status, "application/json; charset=utf-8", gin.H{
+		"status":  "error",
+		"code":    err.Code,
+		"message": err.Message,
+	}
+}
+
+func (keyman *Keyman) renderError(c *gin.Context, err error) {
+	e := AsError(err)
+	if keyman.ErrorRenderer != nil {
+		keyman.ErrorRenderer(c, e)
+		return
+	}
+	status, contentType, body := keyman.errorBody(e, c.GetHeader("Accept"), c.Request.URL.Path)
+	b, _ := json.Marshal(body)
+	c.Data(status, contentType, b)
+}
+
+// AbortError reports err like the built in handlers and stops the chain.
+func (keyman *Keyman) AbortError(c *gin.Context, err error) {
+	keyman.renderError(c, err)
+	c.Abort()
+}
@@ -0,0 +1,126 @@
+package keyman
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"strings"
+	"time"
+)
+
+const (
+	EventLowBalance     = "quota.low"
+	EventQuotaExhausted = "quota.exhausted"
+	EventOverdraft      = "quota.overdraft"
+
+	EventKeyCreated  = "key.created"
+	EventKeyEnabled  = "key.enabled"
+	EventKeyDisabled = "key.disabled"
+	EventKeyDeleted  = "key.deleted"
+	EventKeyExpiring = "key.expiring"
+	EventKeyExpired  = "key.expired"
+
+	EventTokenRevoked = "token.revoked"
+)
+
+// Event is something that happened to a key, or with Target set to an org
+// or pool.
+type Event struct {
+	Type   string    `json:"type"`
+	Key    string    `json:"key"`
+	Target string    `json:"target,omitempty"`
+	Route  string    `json:"route,omitempty"`
+	Value  int64     `json:"value"`
+	Time   time.Time `json:"time"`
+}
+
+type EventHandler func(ev Event)
+
+// Subscribe registers h for every event Keyman emits until unsubscribe is
+// called. Handlers run on the goroutine that caused the event and must not
+// block.
+func (keyman *Keyman) Subscribe(h EventHandler) (unsubscribe func()) {
+	p := &h
+	keyman.eventMu.Lock()
+	defer keyman.eventMu.Unlock()
+	keyman.eventHandlers = append(keyman.eventHandlers, p)
+	return func() {
+		keyman.eventMu.Lock()
+		defer keyman.eventMu.Unlock()
+		// emit ranges over the slice it read, so it is not changed in place
+		handlers := make([]*EventHandler, 0, len(keyman.eventHandlers))
+		for _, q := range keyman.eventHandlers {
+			if q != p {
+				handlers = append(handlers, q)
+			}
+		}
+		keyman.eventHandlers = handlers
+	}
+}
+
+func (keyman *Keyman) emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	keyman.eventMu.RLock()
+	handlers := keyman.eventHandlers
+	keyman.eventMu.RUnlock()
+	for _, h := range handlers {
+		(*h)(ev)
+	}
+}
+
+// CheckExpiry emits key.expiring once for keys that expire within
+// within, and key.expired once for keys whose quota has expired. Enable
+// clears both so they are reported again.
+func (keyman *Keyman) CheckExpiry(within time.Duration) error {
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	keys, err := redis.Strings(redisConn.Do("HKEYS", keyman.rkey("keys")))
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, keyman.Keypre) {
+			continue
+		}
+		key := keyman.keyDelPre(k)
+		ttl, err := redis.Int64(redisConn.Do("TTL", keyman.rkey(k)))
+		if err != nil {
+			return err
+		}
+		switch {
+		case ttl == -2:
+			err = keyman.emitOnce(redisConn, genExpiryKey(EventKeyExpired, key), 0, Event{Type: EventKeyExpired, Key: key})
+		case ttl >= 0 && time.Duration(ttl)*time.Second <= within:
+			err = keyman.emitOnce(redisConn, genExpiryKey(EventKeyExpiring, key), ttl, Event{Type: EventKeyExpiring, Key: key, Value: ttl})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func genExpiryKey(typ, key string) string {
+	return typ + "-" + key
+}
+
+// emit ev unless marker is set, the marker lasts ttl seconds or until Enable
+func (keyman *Keyman) emitOnce(redisConn redis.Conn, marker string, ttl int64, ev Event) error {
+	args := redis.Args{}.Add(keyman.rkey(marker), 1, "NX")
+	if ttl > 0 {
+		args = args.Add("EX", ttl)
+	}
+	_, err := redis.String(redisConn.Do("SET", args...))
+	if err == redis.ErrNil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	keyman.emit(ev)
+	return nil
+}
+
+func (keyman *Keyman) clearExpiry(redisConn redis.Conn, key string) error {
+	_, err := redisConn.Do("DEL", keyman.rkey(genExpiryKey(EventKeyExpiring, key)), keyman.rkey(genExpiryKey(EventKeyExpired, key)))
+	return err
+}
@@ -0,0 +1,65 @@
+package keyman
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (keyman *Keyman) writeHTTPError(w http.ResponseWriter, r *http.Request, err error) {
+	status, contentType, body := keyman.errorBody(AsError(err), r.Header.Get("Accept"), r.URL.Path)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (keyman *Keyman) httpMiddleware(cred func(r *http.Request) Credentials, opts ...RequireOption) func(http.Handler) http.Handler {
+	o := new(requireOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d, err := keyman.Authorize(r.Context(), cred(r), r.URL.Path, opts...)
+			if err != nil {
+				keyman.writeHTTPError(w, r, err)
+				return
+			}
+			if !d.Allow {
+				keyman.writeHTTPError(w, r, d.Err)
+				return
+			}
+
+			if o.headers && d.Identity.Quota != nil {
+				d.Identity.Quota.SetHeaders(w.Header())
+			}
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), d.Identity)))
+		})
+	}
+}
+
+// HTTPRequireKey is the net/http form of RequireKey. Handlers read the
+// identity with FromContext(r.Context()).
+func (keyman *Keyman) HTTPRequireKey(opts ...RequireOption) func(http.Handler) http.Handler {
+	return keyman.httpMiddleware(func(r *http.Request) Credentials {
+		return Credentials{Key: r.Header.Get("key"), Cert: PeerCertificate(r.TLS)}
+	}, opts...)
+}
+
+// HTTPRequireToken is the net/http form of RequireToken.
+func (keyman *Keyman) HTTPRequireToken() func(http.Handler) http.Handler {
+	return keyman.httpMiddleware(func(r *http.Request) Credentials {
+		token := r.Header.Get("token")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		return Credentials{Token: token}
+	})
+}
+
+// HTTPRequireManager is the net/http form of RequireManager.
+func (keyman *Keyman) HTTPRequireManager() func(http.Handler) http.Handler {
+	return keyman.httpMiddleware(func(r *http.Request) Credentials {
+		return Credentials{Key: r.Header.Get("key"), Manager: true}
+	})
+}
@@ -1,29 +1,88 @@
 package keyman
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/bluele/gcache"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/gin-gonic/gin"
 	"github.com/gomodule/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"math/big"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Keyman struct {
-	Keypre     string
+	Keypre string
+	// Namespace prefixes every Redis key of this Keyman, as
+	// "<Namespace>:<key>", so instances with different namespaces share
+	// nothing on one Redis. Empty keeps the keys of older versions.
+	Namespace string
+	// HashTag writes the namespace as the Redis Cluster hash tag
+	// "{<Namespace>}:", so every key of the Keyman, and those of each
+	// multi-key script, hash to one slot. It needs a Namespace.
+	HashTag bool
+
 	RedisPool  *redis.Pool
 	TokenCache gcache.Cache
 	TokenTime  time.Duration
+	// TokenRoutes lets GetToken callers pick the routes of a token with
+	// the route form value, for a gateway whose routes are not under the
+	// token path. Off, a token grants the routes under that path only.
+	TokenRoutes bool
+
+	MaxConcurrent int
+	LeaseTime     time.Duration
+
+	SignatureSkew time.Duration
+
+	// LegacyErrors reports every error as a 200 with status "error", the
+	// shape older clients expect. ProblemJSON answers with RFC 7807 even
+	// when the client did not ask for it.
+	LegacyErrors  bool
+	ProblemJSON   bool
+	ErrorRenderer ErrorRenderer
+
+	Observer Observer
+
+	UsageRetention UsageRetention
+
+	// AuditMaxLen trims the audit log to about this many entries, 0 keeps
+	// all of them.
+	AuditMaxLen int64
+	// TransferMaxLen keeps the last this many transfers in the transfer
+	// log, 10000 when unset.
+	TransferMaxLen int64
+
+	// WebhookRetries is the number of attempts of a webhook delivery
+	// before it goes to the dead letters, 5 when unset.
+	WebhookRetries int
+	// WebhookDeadLen keeps the last this many failed deliveries in the
+	// dead letters, 1000 when unset.
+	WebhookDeadLen int64
+
+	// Tracer traces checks and the Redis commands they make, nil
+	// disables tracing.
+	Tracer trace.Tracer
+
+	consumeSink atomic.Value
+
+	eventMu       sync.RWMutex
+	eventHandlers []*EventHandler
+
+	keyaddrsMu     sync.Mutex
+	keyaddrsFilled bool
 }
 
 type HKey struct {
@@ -40,6 +99,8 @@ type Key struct {
 type TokenInfo struct {
 	Key   string `form:"key" json:"key" xml:"key" binding:"required"`
 	Route string `form:"Route" json:"Route" xml:"Route"`
+	// ID is the TokenID of the token it was looked up with
+	ID string `form:"-" json:"-" xml:"-"`
 }
 
 func (tokenInfo *TokenInfo) Marshal() ([]byte, error) {
@@ -50,6 +111,17 @@ func (tokenInfo *TokenInfo) Unmarshal(data []byte) error {
 	return json.Unmarshal(data, tokenInfo)
 }
 
+// rkey is the Redis key of name in the namespace of keyman.
+func (keyman *Keyman) rkey(name string) string {
+	switch {
+	case keyman.HashTag:
+		return "{" + keyman.Namespace + "}:" + name
+	case keyman.Namespace == "":
+		return name
+	}
+	return keyman.Namespace + ":" + name
+}
+
 func (keyman *Keyman) keyAddPre(key string) string {
 	return keyman.Keypre + key
 }
@@ -81,27 +153,26 @@ func StrToPriv(key string) *ecdsa.PrivateKey {
 	return priv
 }
 
+// InitHandle mounts every route under DefaultPrefix, see Mount to split
+// them across routers or prefixes.
 func (keyman *Keyman) InitHandle(router *gin.Engine) {
-	router.POST("/keymem/enable", keyman.Enable)
-	router.POST("/keymem/addkey", keyman.Addkey)
-	router.POST("/keymem/delkey", keyman.Delkey)
-	router.POST("/keymem/getkey", keyman.Getkey)
-	router.GET("/keymem/listkey", keyman.Listkey)
-	router.POST("/keymem/diskey", keyman.Diskey)
-	router.GET("/keymem/keyaddr", keyman.GetKeyAddr)
-	router.GET("/keymem/getownkey", keyman.Getownkey)
-
-	router.POST("/keymem/addcount", keyman.AddCount)
-	router.POST("/keymem/getcount", keyman.GetCount)
-	router.GET("/keymem/getkeyexpdate", keyman.GetKeyExpdate)
-	router.POST("/keymem/addtotalcount", keyman.AddTotalCount)
+	keyman.Mount(router.Group(DefaultPrefix), RoutesAll)
 }
 
-func (keyman *Keyman) GetPriv(c *gin.Context) (*ecdsa.PrivateKey, error) {
+func (keyman *Keyman) GetPriv(c *gin.Context) (priv *ecdsa.PrivateKey, err error) {
+	ctx, span := keyman.startSpan(c.Request.Context(), "keyman.GetPriv")
+	defer func() {
+		if err == nil && priv == nil {
+			endSpan(span, ErrAccessDenied)
+			return
+		}
+		endSpan(span, err)
+	}()
+
 	key := c.GetHeader("key")
-	redisConn := keyman.RedisPool.Get()
+	redisConn := keyman.redisConnContext(ctx)
 	defer redisConn.Close()
-	isExist, err := redis.Int(redisConn.Do("HEXISTS", "keys", keyman.keyAddPre(key)))
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("keys"), keyman.keyAddPre(key)))
 	if err == redis.ErrNil {
 		return nil, nil
 	} else if err != nil {
@@ -111,41 +182,22 @@ func (keyman *Keyman) GetPriv(c *gin.Context) (*ecdsa.PrivateKey, error) {
 		return nil, nil
 	}
 
-	priv := keyman.StrToPriv(key)
+	priv = keyman.StrToPriv(key)
 	return priv, nil
 }
 
 func (keyman *Keyman) GetManPriv(c *gin.Context) (*ecdsa.PrivateKey, error) {
-	redisConn := keyman.RedisPool.Get()
-	defer redisConn.Close()
-	key := c.GetHeader("key")
-	isExist, err := redis.Int(redisConn.Do("HEXISTS", "mkeys", key))
-	if err == redis.ErrNil {
-		return nil, nil
-	} else if err != nil {
-		return nil, err
-	}
-	if isExist == 0 {
-		return nil, nil
-	}
-	priv := keyman.StrToPriv(key)
-	return priv, nil
+	return keyman.checkManKey(c.Request.Context(), c.GetHeader("key"))
 }
 
 func (keyman *Keyman) Enable(c *gin.Context) {
 	priv, err := keyman.GetManPriv(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "access denied",
-		})
+		keyman.renderError(c, ErrAccessDenied)
 		return
 	}
 
@@ -153,57 +205,58 @@ func (keyman *Keyman) Enable(c *gin.Context) {
 
 	err = c.BindJSON(&key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, badRequest(err.Error()))
 		return
 	}
 
-	redisConn := keyman.RedisPool.Get()
+	redisConn := keyman.redisConn()
 	defer redisConn.Close()
-	isExist, err := redis.Int(redisConn.Do("HEXISTS", "keys", keyman.keyAddPre(key.Key)))
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("keys"), keyman.keyAddPre(key.Key)))
 	if err == redis.ErrNil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "key not exist",
-		})
+		keyman.renderError(c, ErrKeyNotFound)
 		return
 	} else if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if isExist == 0 {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "key not exist",
-		})
+		keyman.renderError(c, ErrKeyNotFound)
 		return
 	}
 
-	_, err = redisConn.Do("SET", keyman.keyAddPre(key.Key), key.Number)
+	before, err := keyman.getKeyState(redisConn, key.Key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 
-	exptime := time.Now()
-	exptime = exptime.Add(time.Duration(key.Expday) * time.Hour * 24)
+	now := time.Now()
+	exptime := now.Add(time.Duration(key.Expday) * time.Hour * 24)
 	sec := exptime.Unix()
-	_, err = redisConn.Do("EXPIREAT", keyman.keyAddPre(key.Key), sec)
+	after := &keyState{Number: key.Number, Sec: sec - now.Unix()}
+	if before != nil {
+		after.Name = before.Name
+	}
+	if after.Sec <= 0 {
+		after.Number, after.Sec = 0, 0
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("SET", keyman.rkey(keyman.keyAddPre(key.Key)), key.Number)
+	redisConn.Send("EXPIREAT", keyman.rkey(keyman.keyAddPre(key.Key)), sec)
+	redisConn.Send("HSET", keyman.rkey("limits"), keyman.keyAddPre(key.Key), key.Number)
+	err = keyman.execAudited(redisConn, c, priv, "enable", KeyToAddrStr(key.Key), before, after)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	err = keyman.clearExpiry(redisConn, key.Key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
+	keyman.emit(Event{Type: EventKeyEnabled, Key: key.Key, Value: key.Number})
 
 	c.JSON(http.StatusOK, gin.H{
 		"status":  "ok",
@@ -215,31 +268,22 @@ func (keyman *Keyman) Enable(c *gin.Context) {
 func (keyman *Keyman) Addkey(c *gin.Context) {
 	priv, err := keyman.GetManPriv(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "access denied",
-		})
+		keyman.renderError(c, ErrAccessDenied)
 		return
 	}
 
 	var key HKey
 	err = c.BindJSON(&key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, badRequest(err.Error()))
 		return
 	}
 
-	redisConn := keyman.RedisPool.Get()
+	redisConn := keyman.redisConn()
 	defer redisConn.Close()
 
 	if len(key.Key) < 70 {
@@ -247,15 +291,17 @@ func (keyman *Keyman) Addkey(c *gin.Context) {
 		key.Key = k.D.String()
 	}
 
-	_, err = redisConn.Do("HSET", "keys", keyman.keyAddPre(key.Key), key.Name)
+	redisConn.Send("MULTI")
+	redisConn.Send("HSET", keyman.rkey("keys"), keyman.keyAddPre(key.Key), key.Name)
+	redisConn.Send("HSET", keyman.rkey("keyaddrs"), KeyToAddrStr(key.Key), key.Key)
+	err = keyman.execAudited(redisConn, c, priv, "addkey", KeyToAddrStr(key.Key), nil, gin.H{"name": key.Name})
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 
+	keyman.emit(Event{Type: EventKeyCreated, Key: key.Key})
+
 	c.JSON(http.StatusOK, gin.H{
 		"status": "ok",
 		"key":    key.Key,
@@ -267,49 +313,47 @@ func (keyman *Keyman) Addkey(c *gin.Context) {
 func (keyman *Keyman) Delkey(c *gin.Context) {
 	priv, err := keyman.GetManPriv(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "access denied",
-		})
+		keyman.renderError(c, ErrAccessDenied)
 		return
 	}
 
 	var key HKey
 	err = c.BindJSON(&key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, badRequest(err.Error()))
 		return
 	}
 
 	if len(key.Key) < 70 {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "too less",
-		})
+		keyman.renderError(c, ErrKeyInvalid)
 		return
 	}
 
-	redisConn := keyman.RedisPool.Get()
+	redisConn := keyman.redisConn()
 	defer redisConn.Close()
 
-	_, err = redisConn.Do("HDEL", "keys", keyman.keyAddPre(key.Key))
+	before, err := keyman.getKeyState(redisConn, key.Key)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	redisConn.Send("MULTI")
+	for _, name := range []string{"keys", "keyorgs", "keypools", "limits", "policies"} {
+		redisConn.Send("HDEL", keyman.rkey(name), keyman.keyAddPre(key.Key))
+	}
+	redisConn.Send("HDEL", keyman.rkey("keyaddrs"), KeyToAddrStr(key.Key))
+	redisConn.Send("DEL", keyman.rkey(genExpiryKey(EventKeyExpiring, key.Key)), keyman.rkey(genExpiryKey(EventKeyExpired, key.Key)))
+	err = keyman.execAudited(redisConn, c, priv, "delkey", KeyToAddrStr(key.Key), before, nil)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
+	keyman.emit(Event{Type: EventKeyDeleted, Key: key.Key})
 
 	c.JSON(http.StatusOK, gin.H{
 		"status": "ok",
@@ -320,68 +364,47 @@ func (keyman *Keyman) Delkey(c *gin.Context) {
 func (keyman *Keyman) Getkey(c *gin.Context) {
 	priv, err := keyman.GetManPriv(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "access denied",
-		})
+		keyman.renderError(c, ErrAccessDenied)
 		return
 	}
 
 	var key HKey
 	err = c.BindJSON(&key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, badRequest(err.Error()))
 		return
 	}
 
-	redisConn := keyman.RedisPool.Get()
+	redisConn := keyman.redisConn()
 	defer redisConn.Close()
 
-	name, err := redis.String(redisConn.Do("HGET", "keys", keyman.keyAddPre(key.Key)))
+	name, err := redis.String(redisConn.Do("HGET", keyman.rkey("keys"), keyman.keyAddPre(key.Key)))
 	if err == redis.ErrNil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "key not exist",
-		})
+		keyman.renderError(c, ErrKeyNotFound)
 		return
 	} else if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 
-	sec, err := redis.Int(redisConn.Do("TTL", keyman.keyAddPre(key.Key)))
+	sec, err := redis.Int(redisConn.Do("TTL", keyman.rkey(keyman.keyAddPre(key.Key))))
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if sec < 0 {
 		sec = 0
 	}
 
-	number, err := redis.Int(redisConn.Do("GET", keyman.keyAddPre(key.Key)))
+	number, err := redis.Int(redisConn.Do("GET", keyman.rkey(keyman.keyAddPre(key.Key))))
 	if err == redis.ErrNil {
 		number = 0
 	} else if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 
@@ -400,29 +423,20 @@ func (keyman *Keyman) Getkey(c *gin.Context) {
 func (keyman *Keyman) Listkey(c *gin.Context) {
 	priv, err := keyman.GetManPriv(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "access denied",
-		})
+		keyman.renderError(c, ErrAccessDenied)
 		return
 	}
 
-	redisConn := keyman.RedisPool.Get()
+	redisConn := keyman.redisConn()
 	defer redisConn.Close()
 
-	keys, err := redis.Strings(redisConn.Do("HKEYS", "keys"))
+	keys, err := redis.Strings(redisConn.Do("HKEYS", keyman.rkey("keys")))
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 
@@ -443,50 +457,51 @@ func (keyman *Keyman) Listkey(c *gin.Context) {
 func (keyman *Keyman) Diskey(c *gin.Context) {
 	priv, err := keyman.GetManPriv(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "access denied",
-		})
+		keyman.renderError(c, ErrAccessDenied)
 		return
 	}
 
 	var key HKey
 	err = c.BindJSON(&key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, badRequest(err.Error()))
 		return
 	}
 
 	if len(key.Key) < 70 {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "too less",
-		})
+		keyman.renderError(c, ErrKeyInvalid)
 		return
 	}
 
-	redisConn := keyman.RedisPool.Get()
+	redisConn := keyman.redisConn()
 	defer redisConn.Close()
 
-	_, err = redisConn.Do("DEL", keyman.keyAddPre(key.Key))
+	before, err := keyman.getKeyState(redisConn, key.Key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 
+	var after *keyState
+	if before != nil {
+		after = &keyState{Name: before.Name}
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("DEL", keyman.rkey(keyman.keyAddPre(key.Key)))
+	// disabled, not expired
+	redisConn.Send("SET", keyman.rkey(genExpiryKey(EventKeyExpired, key.Key)), 1)
+	err = keyman.execAudited(redisConn, c, priv, "diskey", KeyToAddrStr(key.Key), before, after)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	keyman.emit(Event{Type: EventKeyDisabled, Key: key.Key})
+
 	c.JSON(http.StatusOK, gin.H{
 		"status": "ok",
 		"key":    key.Key,
@@ -500,44 +515,32 @@ func (keyman *Keyman) Getownkey(c *gin.Context) {
 
 	key := c.GetHeader("key")
 
-	redisConn := keyman.RedisPool.Get()
+	redisConn := keyman.redisConn()
 	defer redisConn.Close()
 
-	name, err := redis.String(redisConn.Do("HGET", "keys", keyman.keyAddPre(key)))
+	name, err := redis.String(redisConn.Do("HGET", keyman.rkey("keys"), keyman.keyAddPre(key)))
 	if err == redis.ErrNil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "key not exist",
-		})
+		keyman.renderError(c, ErrKeyNotFound)
 		return
 	} else if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 
-	sec, err := redis.Int(redisConn.Do("TTL", keyman.keyAddPre(key)))
+	sec, err := redis.Int(redisConn.Do("TTL", keyman.rkey(keyman.keyAddPre(key))))
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if sec < 0 {
 		sec = 0
 	}
 
-	number, err := redis.Int(redisConn.Do("GET", keyman.keyAddPre(key)))
+	number, err := redis.Int(redisConn.Do("GET", keyman.rkey(keyman.keyAddPre(key))))
 	if err == redis.ErrNil {
 		number = 0
 	} else if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 
@@ -556,95 +559,59 @@ func (keyman *Keyman) Getownkey(c *gin.Context) {
 func (keyman *Keyman) AddCount(c *gin.Context) {
 	priv, err := keyman.GetManPriv(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "access denied",
-		})
+		keyman.renderError(c, ErrAccessDenied)
 		return
 	}
 
 	key := c.Request.FormValue("key")
 	if strings.EqualFold("", key) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "require key",
-		})
+		keyman.renderError(c, badRequest("require key"))
 		return
 	}
 
 	reqpath := c.Request.FormValue("reqpath")
 	if strings.EqualFold("", reqpath) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "require reqpath",
-		})
+		keyman.renderError(c, badRequest("require reqpath"))
 		return
 	}
 
 	count := c.Request.FormValue("count")
 	if strings.EqualFold("", count) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "require count",
-		})
+		keyman.renderError(c, badRequest("require count"))
 		return
 	}
 
 	countInt, err := strconv.Atoi(count)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "count error",
-		})
+		keyman.renderError(c, badRequest("count error"))
 		return
 	}
 
-	redisConn := keyman.RedisPool.Get()
+	redisConn := keyman.redisConn()
 	defer redisConn.Close()
-	isExist, err := redis.Int(redisConn.Do("HEXISTS", "keys", keyman.keyAddPre(key)))
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("keys"), keyman.keyAddPre(key)))
 	if err == redis.ErrNil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "key not exist",
-		})
+		keyman.renderError(c, ErrKeyNotFound)
 		return
 	} else if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if isExist == 0 {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "key not exist",
-		})
-		return
-	}
-
-	_, err = redisConn.Do("INCRBY", genCountKey(reqpath, key), countInt)
-	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, ErrKeyNotFound)
 		return
 	}
 
-	_, err = redisConn.Do("INCRBY", genTotalCountKey(reqpath, key), countInt)
+	_, err = keyman.auditIncr(redisConn, c, priv, "addcount", KeyToAddrStr(key), int64(countInt),
+		[]string{keyman.rkey(genCountKey(reqpath, key)), keyman.rkey(genTotalCountKey(reqpath, key))},
+		[]string{"number", "total"},
+		gin.H{"reqpath": reqpath}, gin.H{"reqpath": reqpath})
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 
@@ -656,86 +623,58 @@ func (keyman *Keyman) AddCount(c *gin.Context) {
 func (keyman *Keyman) AddTotalCount(c *gin.Context) {
 	priv, err := keyman.GetManPriv(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "access denied",
-		})
+		keyman.renderError(c, ErrAccessDenied)
 		return
 	}
 
 	key := c.Request.FormValue("key")
 	if strings.EqualFold("", key) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "require key",
-		})
+		keyman.renderError(c, badRequest("require key"))
 		return
 	}
 
 	reqpath := c.Request.FormValue("reqpath")
 	if strings.EqualFold("", reqpath) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "require reqpath",
-		})
+		keyman.renderError(c, badRequest("require reqpath"))
 		return
 	}
 
 	count := c.Request.FormValue("count")
 	if strings.EqualFold("", count) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "require count",
-		})
+		keyman.renderError(c, badRequest("require count"))
 		return
 	}
 
 	countInt, err := strconv.Atoi(count)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "count error",
-		})
+		keyman.renderError(c, badRequest("count error"))
 		return
 	}
 
-	redisConn := keyman.RedisPool.Get()
+	redisConn := keyman.redisConn()
 	defer redisConn.Close()
-	isExist, err := redis.Int(redisConn.Do("HEXISTS", "keys", keyman.keyAddPre(key)))
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("keys"), keyman.keyAddPre(key)))
 	if err == redis.ErrNil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "key not exist",
-		})
+		keyman.renderError(c, ErrKeyNotFound)
 		return
 	} else if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if isExist == 0 {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "key not exist",
-		})
+		keyman.renderError(c, ErrKeyNotFound)
 		return
 	}
 
-	_, err = redisConn.Do("INCRBY", genTotalCountKey(reqpath, key), countInt)
+	_, err = keyman.auditIncr(redisConn, c, priv, "addtotalcount", KeyToAddrStr(key), int64(countInt),
+		[]string{keyman.rkey(genTotalCountKey(reqpath, key))}, []string{"total"},
+		gin.H{"reqpath": reqpath}, gin.H{"reqpath": reqpath})
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 
@@ -753,35 +692,26 @@ func (keyman *Keyman) GetCount(c *gin.Context) {
 
 	reqpath := c.Request.FormValue("reqpath")
 	if strings.EqualFold("", reqpath) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "require reqpath",
-		})
+		keyman.renderError(c, badRequest("require reqpath"))
 		return
 	}
 
-	redisConn := keyman.RedisPool.Get()
+	redisConn := keyman.redisConn()
 	defer redisConn.Close()
 
-	number, err := redis.Int(redisConn.Do("GET", genCountKey(reqpath, key)))
+	number, err := redis.Int(redisConn.Do("GET", keyman.rkey(genCountKey(reqpath, key))))
 	if err == redis.ErrNil {
 		number = 0
 	} else if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 
-	totalNumber, err := redis.Int(redisConn.Do("GET", genTotalCountKey(reqpath, key)))
+	totalNumber, err := redis.Int(redisConn.Do("GET", keyman.rkey(genTotalCountKey(reqpath, key))))
 	if err == redis.ErrNil {
 		totalNumber = 0
 	} else if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 
@@ -799,15 +729,12 @@ func (keyman *Keyman) GetKeyExpdate(c *gin.Context) {
 
 	key := c.GetHeader("key")
 
-	redisConn := keyman.RedisPool.Get()
+	redisConn := keyman.redisConn()
 	defer redisConn.Close()
 
-	sec, err := redis.Int(redisConn.Do("TTL", keyman.keyAddPre(key)))
+	sec, err := redis.Int(redisConn.Do("TTL", keyman.rkey(keyman.keyAddPre(key))))
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if sec < 0 {
@@ -824,42 +751,94 @@ func (keyman *Keyman) GetKeyExpdate(c *gin.Context) {
 }
 
 func (keyman *Keyman) CheckKey(key string) error {
+	return keyman.checkKey(context.Background(), key)
+}
+
+func (keyman *Keyman) checkKey(ctx context.Context, key string) (err error) {
+	ctx, span := keyman.startSpan(ctx, "keyman.CheckKey")
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	// is key valid
-	redisConn := keyman.RedisPool.Get()
+	redisConn := keyman.redisConnContext(ctx)
 	defer redisConn.Close()
-	num, err := redis.Int(redisConn.Do("GET", keyman.keyAddPre(key)))
+	num, err := redis.Int(redisConn.Do("GET", keyman.rkey(keyman.keyAddPre(key))))
 	if err == redis.ErrNil {
-		return errors.New("Expiry date")
+		return ErrKeyExpired
 	} else if err != nil {
 		return err
 	}
 	if num <= 0 {
-		return errors.New("Exceed quota of use")
+		err = keyman.checkKeyPool(ctx, key)
+		if err != nil {
+			err = keyman.checkOverdraft(ctx, key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	org, err := keyman.getKeyOrg(ctx, key)
+	if err != nil {
+		return err
+	}
+	if org != "" {
+		return keyman.checkOrg(ctx, org)
 	}
 	return nil
 }
 
 func (keyman *Keyman) CheckPathKeyCount(reqpath, key string) error {
-	redisConn := keyman.RedisPool.Get()
+	return keyman.checkPathKeyCount(context.Background(), reqpath, key)
+}
+
+func (keyman *Keyman) checkPathKeyCount(ctx context.Context, reqpath, key string) (err error) {
+	ctx, span := keyman.startSpan(ctx, "keyman.CheckPathKeyCount", attribute.String("keyman.route", reqpath))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	redisConn := keyman.redisConnContext(ctx)
 	defer redisConn.Close()
-	number, err := redis.Int(redisConn.Do("GET", genCountKey(reqpath, key)))
+	number, err := redis.Int(redisConn.Do("GET", keyman.rkey(genCountKey(reqpath, key))))
 	if err != nil {
-		return errors.New("Exceed quota of use")
+		return ErrQuotaExhausted
 	}
 	if number <= 0 {
-		return errors.New("Exceed quota of use")
+		return ErrQuotaExhausted
+	}
+
+	org, err := keyman.getKeyOrg(ctx, key)
+	if err != nil {
+		return err
+	}
+	if org != "" {
+		return keyman.checkOrgPathCount(ctx, reqpath, org)
 	}
-	return err
+	return nil
 }
 
 func (keyman *Keyman) DecPathKeyCount(reqpath, key string) error {
-	redisConn := keyman.RedisPool.Get()
-	defer redisConn.Close()
+	org, err := keyman.GetKeyOrg(key)
+	if err != nil {
+		return err
+	}
 
-	_, err := redisConn.Do("DECR", genCountKey(reqpath, key))
+	keys := []string{keyman.rkey(genCountKey(reqpath, key))}
+	modes := []string{debitRequired}
+	if org != "" {
+		keys = append(keys, keyman.rkey(genCountKey(reqpath, genOrgKey(org))))
+		modes = append(modes, debitOptional)
+	}
+	failed, remaining, err := keyman.debit(context.Background(), keys, modes, 1)
 	if err != nil {
 		return err
 	}
+	if failed > 0 {
+		keyman.emit(Event{Type: EventQuotaExhausted, Key: key, Route: reqpath, Value: remaining})
+		return ErrQuotaExhausted
+	}
 	return nil
 }
 
@@ -867,22 +846,28 @@ func (keyman *Keyman) DecPathKeyCountHandle(c *gin.Context) bool {
 	key := c.GetHeader("key")
 	err := keyman.DecPathKeyCount(c.Request.URL.Path, key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "dec count failed",
-		})
+		keyman.renderError(c, ErrConsumeFailed)
 		return false
 	}
 	return true
 }
 
 func (keyman *Keyman) CheckKeyOnlytime(key string) error {
+	return keyman.checkKeyOnlytime(context.Background(), key)
+}
+
+func (keyman *Keyman) checkKeyOnlytime(ctx context.Context, key string) (err error) {
+	ctx, span := keyman.startSpan(ctx, "keyman.CheckKeyOnlytime")
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	// is key valid
-	redisConn := keyman.RedisPool.Get()
+	redisConn := keyman.redisConnContext(ctx)
 	defer redisConn.Close()
-	_, err := redis.Int(redisConn.Do("GET", keyman.keyAddPre(key)))
+	_, err = redis.Int(redisConn.Do("GET", keyman.rkey(keyman.keyAddPre(key))))
 	if err == redis.ErrNil {
-		return errors.New("Expiry date")
+		return ErrKeyExpired
 	} else if err != nil {
 		return err
 	}
@@ -892,28 +877,19 @@ func (keyman *Keyman) CheckKeyOnlytime(key string) error {
 func (keyman *Keyman) IsKeyValid(c *gin.Context) bool {
 	priv, err := keyman.GetPriv(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return false
 	}
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "access denied",
-		})
+		keyman.renderError(c, ErrAccessDenied)
 		return false
 	}
 
 	// is key valid
 	key := priv.D.String()
-	err = keyman.CheckKey(key)
+	err = keyman.checkKey(c.Request.Context(), key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return false
 	}
 	return true
@@ -922,28 +898,19 @@ func (keyman *Keyman) IsKeyValid(c *gin.Context) bool {
 func (keyman *Keyman) IsKeyValidOnlytime(c *gin.Context) bool {
 	priv, err := keyman.GetPriv(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return false
 	}
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "access denied",
-		})
+		keyman.renderError(c, ErrAccessDenied)
 		return false
 	}
 
 	// is key valid
 	key := priv.D.String()
-	err = keyman.CheckKeyOnlytime(key)
+	err = keyman.checkKeyOnlytime(c.Request.Context(), key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return false
 	}
 	return true
@@ -952,28 +919,19 @@ func (keyman *Keyman) IsKeyValidOnlytime(c *gin.Context) bool {
 func (keyman *Keyman) IsKeyValidRet(c *gin.Context) (*ecdsa.PrivateKey, bool) {
 	priv, err := keyman.GetPriv(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return priv, false
 	}
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "access denied",
-		})
+		keyman.renderError(c, ErrAccessDenied)
 		return priv, false
 	}
 
 	// is key valid
 	key := priv.D.String()
-	err = keyman.CheckKey(key)
+	err = keyman.checkKey(c.Request.Context(), key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return priv, false
 	}
 	return priv, true
@@ -982,38 +940,26 @@ func (keyman *Keyman) IsKeyValidRet(c *gin.Context) (*ecdsa.PrivateKey, bool) {
 func (keyman *Keyman) IsPathKeyValid(c *gin.Context) bool {
 	priv, err := keyman.GetPriv(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return false
 	}
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "access denied",
-		})
+		keyman.renderError(c, ErrAccessDenied)
 		return false
 	}
 
 	// is key valid
 	key := priv.D.String()
 
-	keyman.CheckKeyOnlytime(key)
+	keyman.checkKeyOnlytime(c.Request.Context(), key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return false
 	}
 
-	err = keyman.CheckPathKeyCount(c.Request.URL.Path, key)
+	err = keyman.checkPathKeyCount(c.Request.Context(), c.Request.URL.Path, key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return false
 	}
 	return true
@@ -1022,38 +968,26 @@ func (keyman *Keyman) IsPathKeyValid(c *gin.Context) bool {
 func (keyman *Keyman) IsPathKeyValidRet(c *gin.Context) (*ecdsa.PrivateKey, bool) {
 	priv, err := keyman.GetPriv(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return priv, false
 	}
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "access denied",
-		})
+		keyman.renderError(c, ErrAccessDenied)
 		return priv, false
 	}
 
 	// is key valid
 	key := priv.D.String()
 
-	keyman.CheckKeyOnlytime(key)
+	keyman.checkKeyOnlytime(c.Request.Context(), key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return priv, false
 	}
 
-	err = keyman.CheckPathKeyCount(c.Request.URL.Path, key)
+	err = keyman.checkPathKeyCount(c.Request.Context(), c.Request.URL.Path, key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return priv, false
 	}
 	return priv, true
@@ -1062,17 +996,11 @@ func (keyman *Keyman) IsPathKeyValidRet(c *gin.Context) (*ecdsa.PrivateKey, bool
 func (keyman *Keyman) GetKeyAddr(c *gin.Context) {
 	priv, err := keyman.GetPriv(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "access denied",
-		})
+		keyman.renderError(c, ErrAccessDenied)
 		return
 	}
 	addr := crypto.PubkeyToAddress(priv.PublicKey)
@@ -1085,13 +1013,12 @@ func (keyman *Keyman) GetKeyAddr(c *gin.Context) {
 }
 
 func (keyman *Keyman) DecKeyNum(key string) error {
-	redisConn := keyman.RedisPool.Get()
-	defer redisConn.Close()
-	_, err := redisConn.Do("DECR", keyman.keyAddPre(key))
-	return err
+	return keyman.Consume("", key)
 }
 
-// token route access
+// GetToken issues a token for the key in the header. The token grants the
+// routes under the path it was asked on, or with TokenRoutes under the
+// route form value, e.g. the prefix of a gateway route.
 func (keyman *Keyman) GetToken(c *gin.Context) {
 	if !keyman.IsKeyValid(c) {
 		return
@@ -1101,106 +1028,136 @@ func (keyman *Keyman) GetToken(c *gin.Context) {
 
 	priv := keyman.StrToPriv(key)
 	if priv == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "key error",
-		})
+		keyman.renderError(c, badRequest("key error"))
 		return
 	}
 
-	err := keyman.CheckKey(key)
+	err := keyman.checkKey(c.Request.Context(), key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
+		return
 	}
 
 	token := MakeToken(priv)
 	tokeninfo := new(TokenInfo)
 	tokeninfo.Key = key
 	tokeninfo.Route = c.Request.URL.Path
+	if route := c.Request.FormValue("route"); route != "" {
+		if !keyman.TokenRoutes || !strings.HasPrefix(route, "/") {
+			keyman.renderError(c, badRequest("route error"))
+			return
+		}
+		tokeninfo.Route = route
+	}
 	b, err := tokeninfo.Marshal()
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
+		keyman.renderError(c, err)
 		return
 	}
 	keyman.TokenCache.SetWithExpire(token, b, keyman.TokenTime)
+	if keyman.Observer != nil {
+		keyman.Observer.TokenIssued()
+	}
 	c.Header("token", token)
 	c.JSON(http.StatusOK, gin.H{
 		"status": "ok",
 	})
 }
 
-func (keyman *Keyman) CheckToken(c *gin.Context) *TokenInfo {
-	token := c.GetHeader("token")
+// LookupToken returns the token info of a live token that grants route.
+func (keyman *Keyman) LookupToken(token, route string) (*TokenInfo, error) {
+	return keyman.lookupToken(context.Background(), token, route)
+}
+
+func (keyman *Keyman) lookupToken(ctx context.Context, token, route string) (tokeninfo *TokenInfo, err error) {
+	ctx, span := keyman.startSpan(ctx, "keyman.LookupToken", attribute.String("keyman.route", route))
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	b, err := keyman.TokenCache.Get(token)
+	if keyman.Observer != nil {
+		keyman.Observer.TokenChecked(err == nil)
+	}
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "token not exist",
-		})
-		return nil
+		return nil, ErrTokenInvalid
 	}
 
-	tokeninfo := new(TokenInfo)
+	tokeninfo = new(TokenInfo)
 	tokeninfo.Unmarshal(b.([]byte))
+	tokeninfo.ID = TokenID(token)
 
-	if !strings.HasPrefix(c.Request.URL.Path, tokeninfo.Route) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "route denied",
-		})
-		return nil
+	if !strings.HasPrefix(route, tokeninfo.Route) {
+		return nil, ErrRouteDenied
 	}
 
-	err = keyman.CheckKey(tokeninfo.Key)
+	err = keyman.checkKey(ctx, tokeninfo.Key)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
-		return nil
+		return nil, err
 	}
 
+	return tokeninfo, nil
+}
+
+func (keyman *Keyman) CheckToken(c *gin.Context) *TokenInfo {
+	token := c.GetHeader("token")
+	tokeninfo, err := keyman.lookupToken(c.Request.Context(), token, c.Request.URL.Path)
+	if err != nil {
+		keyman.renderError(c, err)
+		return nil
+	}
 	return tokeninfo
 }
 
 func (keyman *Keyman) CheckGetToken(c *gin.Context) *TokenInfo {
 	token, _ := c.GetQuery("token")
-	b, err := keyman.TokenCache.Get(token)
+	tokeninfo, err := keyman.lookupToken(c.Request.Context(), token, c.Request.URL.Path)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "token not exist",
-		})
+		keyman.renderError(c, err)
 		return nil
 	}
+	return tokeninfo
+}
+
+// RevokeToken drops a token. Its key, or a management key, may revoke it.
+func (keyman *Keyman) RevokeToken(c *gin.Context) {
+	token := c.Request.FormValue("token")
+	if strings.EqualFold("", token) {
+		keyman.renderError(c, badRequest("require token"))
+		return
+	}
 
+	b, err := keyman.TokenCache.Get(token)
+	if err != nil {
+		keyman.renderError(c, ErrTokenInvalid)
+		return
+	}
 	tokeninfo := new(TokenInfo)
 	tokeninfo.Unmarshal(b.([]byte))
+	tokeninfo.ID = TokenID(token)
 
-	if !strings.HasPrefix(c.Request.URL.Path, tokeninfo.Route) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": "route denied",
-		})
-		return nil
+	key := c.GetHeader("key")
+	if key != tokeninfo.Key {
+		priv, err := keyman.GetManPriv(c)
+		if err != nil {
+			keyman.renderError(c, err)
+			return
+		}
+		if priv == nil {
+			keyman.renderError(c, ErrAccessDenied)
+			return
+		}
+		if !keyman.auditKey(c, priv, "revoketoken", tokeninfo.Key, nil, gin.H{"route": tokeninfo.Route}) {
+			return
+		}
 	}
 
-	err = keyman.CheckKey(tokeninfo.Key)
-	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
-		return nil
-	}
+	keyman.TokenCache.Remove(token)
+	keyman.emit(Event{Type: EventTokenRevoked, Key: tokeninfo.Key, Route: tokeninfo.Route})
 
-	return tokeninfo
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
 }
 
 func MakeToken(priv *ecdsa.PrivateKey) string {
@@ -1218,7 +1175,7 @@ func MakeToken(priv *ecdsa.PrivateKey) string {
 
 func TokenToPubStr(token string) (string, error) {
 	if len(token) != 194 {
-		return "", errors.New("tooken error")
+		return "", ErrTokenMalformed
 	}
 	hash, err := hex.DecodeString(token[0:64])
 	if err != nil {
@@ -1234,7 +1191,7 @@ func TokenToPubStr(token string) (string, error) {
 
 func TokenToPub(token string) (*ecdsa.PublicKey, error) {
 	if len(token) != 194 {
-		return nil, errors.New("tooken error")
+		return nil, ErrTokenMalformed
 	}
 	hash, err := hex.DecodeString(token[0:64])
 	if err != nil {
@@ -1,8 +1,27 @@
 package keyman
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bluele/gcache"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestTokenInfoMarshal(t *testing.T) {
@@ -46,3 +65,1028 @@ func TestTokenSign(t *testing.T) {
 	}
 	t.Log(addrStr)
 }
+
+func TestQuotaHeaders(t *testing.T) {
+	q := new(Quota)
+	q.Exist = true
+	q.Enabled = true
+	q.Number = 7
+	q.Limit = 10
+	q.Sec = 3600
+	q.Expdate = time.Now().Add(time.Hour)
+
+	h := make(http.Header)
+	q.SetHeaders(h)
+	if h.Get("X-Quota-Remaining") != "7" || h.Get("RateLimit-Limit") != "10" || h.Get("RateLimit-Reset") != "3600" {
+		t.Fatal(h)
+	}
+
+	q.Reqpath = "/a/b"
+	q.PathCount = 2
+	q.PathTotal = 5
+	h = make(http.Header)
+	q.SetHeaders(h)
+	if h.Get("X-Quota-Path-Remaining") != "2" || h.Get("RateLimit-Limit") != "5" || h.Get("RateLimit-Remaining") != "2" {
+		t.Fatal(h)
+	}
+}
+
+func TestQuotaWarning(t *testing.T) {
+	q := new(Quota)
+	q.Number = 3
+	q.Policy.Soft = 5
+	h := make(http.Header)
+	q.SetHeaders(h)
+	if h.Get("X-Quota-Warning") != "low balance" {
+		t.Fatal(h)
+	}
+
+	q.Number = 0
+	q.Policy.Overdraft = 10
+	q.Overdraft = 4
+	h = make(http.Header)
+	q.SetHeaders(h)
+	if h.Get("X-Quota-Warning") != "overdraft" || h.Get("X-Quota-Overdraft-Remaining") != "6" {
+		t.Fatal(h)
+	}
+}
+
+func TestIdentityContext(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	if _, ok := GetIdentity(c); ok {
+		t.Fatal("identity without middleware")
+	}
+
+	tokeninfo := &TokenInfo{Key: "aaa", Route: "/a"}
+	setIdentity(c, &Identity{Key: "aaa", Token: tokeninfo})
+	id, ok := GetIdentity(c)
+	if !ok || id.Key != "aaa" {
+		t.Fatal(id)
+	}
+	if ti, ok := GetTokenInfo(c); !ok || ti != tokeninfo {
+		t.Fatal(ti)
+	}
+	if _, ok := GetKeyQuota(c); ok {
+		t.Fatal("quota without key check")
+	}
+}
+
+func TestAbortError(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/test", nil)
+	keym := new(Keyman)
+	keym.AbortError(c, ErrAccessDenied)
+	if !c.IsAborted() {
+		t.Fatal("not aborted")
+	}
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal(w.Code)
+	}
+	t.Log(w.Body.String())
+}
+
+func TestErrorBody(t *testing.T) {
+	keym := new(Keyman)
+	status, contentType, _ := keym.errorBody(AsError(errors.New("boom")), "", "/test")
+	if status != http.StatusInternalServerError || contentType != "application/json; charset=utf-8" {
+		t.Fatal(status, contentType)
+	}
+	status, contentType, body := keym.errorBody(ErrQuotaExhausted, "application/problem+json", "/test")
+	if status != http.StatusTooManyRequests || contentType != "application/problem+json" {
+		t.Fatal(status, contentType)
+	}
+	if body.(gin.H)["code"] != "QUOTA_EXHAUSTED" || body.(gin.H)["instance"] != "/test" {
+		t.Fatal(body)
+	}
+
+	keym.LegacyErrors = true
+	status, _, body = keym.errorBody(ErrQuotaExhausted, "application/problem+json", "/test")
+	if status != http.StatusOK || body.(gin.H)["message"] != "Exceed quota of use" {
+		t.Fatal(status, body)
+	}
+}
+
+func TestIdentityRequestContext(t *testing.T) {
+	id := &Identity{Key: "aaa", Name: "test"}
+	ctx := NewContext(context.Background(), id)
+	if got, ok := FromContext(ctx); !ok || got != id {
+		t.Fatal(got)
+	}
+	if _, ok := FromContext(context.Background()); ok {
+		t.Fatal("identity in empty context")
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/a", nil).WithContext(ctx)
+	if got, ok := GetIdentity(c); !ok || got != id {
+		t.Fatal(got)
+	}
+}
+
+func TestUsageQuery(t *testing.T) {
+	if statusClass(204) != "2xx" || statusClass(429) != "4xx" || statusClass(0) != "other" {
+		t.Fatal("status class")
+	}
+	keym := new(Keyman)
+	now := time.Now()
+	if _, err := keym.QueryUsage("aaa", "week", now.Add(-time.Hour), now, nil); err == nil {
+		t.Fatal("resolution")
+	}
+	if _, err := keym.QueryUsage("aaa", UsageMinute, now.Add(-30*24*time.Hour), now, nil); err == nil {
+		t.Fatal("range")
+	}
+	if _, err := keym.QueryUsage("aaa", UsageHour, now, now.Add(-time.Hour), nil); err == nil {
+		t.Fatal("reversed range")
+	}
+	if _, err := keym.QueryUsage("aaa", UsageHour, now.Add(-time.Hour), now, []string{"plan"}); err == nil {
+		t.Fatal("group")
+	}
+}
+
+func TestParseAuditEntry(t *testing.T) {
+	v := []interface{}{
+		[]byte("1700000000000-0"),
+		[]interface{}{
+			[]byte("time"), []byte("1700000000"),
+			[]byte("action"), []byte("enable"),
+			[]byte("target"), []byte("0x01"),
+			[]byte("after"), []byte(`{"number":10}`),
+		},
+	}
+	entry, err := parseAuditEntry(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.ID != "1700000000000-0" || entry.Time != 1700000000 || entry.Action != "enable" || entry.After != `{"number":10}` {
+		t.Fatal(entry)
+	}
+}
+
+func TestWebhookDeliver(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Keymem-Signature") != SignWebhook("secret", r.Header.Get("X-Keymem-Timestamp"), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		got = r.Header.Get("X-Keymem-Event")
+	}))
+	defer server.Close()
+
+	keym := new(Keyman)
+	job := &webhookJob{
+		webhook:  &Webhook{URL: server.URL, Secret: "secret", Events: []string{EventKeyExpired}},
+		payload:  []byte(`{"type":"key.expired"}`),
+		delivery: &Delivery{Event: EventKeyExpired},
+	}
+	if !job.webhook.wants(EventKeyExpired) || job.webhook.wants(EventKeyCreated) {
+		t.Fatal("wants")
+	}
+	if !keym.deliver(server.Client(), job) || got != EventKeyExpired {
+		t.Fatal(job.delivery)
+	}
+
+	job.webhook.Secret = "other"
+	if keym.deliver(server.Client(), job) || job.delivery.Code != http.StatusUnauthorized || job.delivery.Attempts != 2 {
+		t.Fatal(job.delivery)
+	}
+}
+
+func TestWebhookDeadTrim(t *testing.T) {
+	keym, mr := newTestKeyman(t)
+	keym.WebhookDeadLen = 2
+	for i := 0; i < 3; i++ {
+		job := &webhookJob{
+			webhook:  &Webhook{URL: "http://127.0.0.1:1"},
+			payload:  []byte(`{"type":"key.expired"}`),
+			delivery: &Delivery{Event: EventKeyExpired},
+		}
+		keym.finishDelivery(job, false)
+	}
+	dead, err := mr.List(keym.rkey("webhookdead"))
+	if err != nil || len(dead) != 2 {
+		t.Fatal(dead, err)
+	}
+}
+
+func TestWebhookStop(t *testing.T) {
+	keym, mr := newTestKeyman(t)
+	mr.HSet(keym.rkey("webhooks"), "w1", `{"id":"w1","url":"http://127.0.0.1:1"}`)
+	stop := keym.StartWebhooks(1)
+	stop()
+	keym.emit(Event{Type: EventKeyCreated, Key: "k1"})
+	if len(keym.eventHandlers) != 0 {
+		t.Fatal("dispatcher still subscribed")
+	}
+	if mr.Exists(keym.rkey("webhookdead")) {
+		t.Fatal("event dispatched after stop")
+	}
+}
+
+func TestQuotaExhaustedEvent(t *testing.T) {
+	keym, mr := newTestKeyman(t)
+	api := newTestAPI(t, keym, mr)
+	key := api.addKey(3)
+	var events []Event
+	keym.Subscribe(func(ev Event) {
+		if ev.Type == EventQuotaExhausted {
+			events = append(events, ev)
+		}
+	})
+
+	// a debit that would go below zero is refused and reported
+	if err := keym.ConsumeN("", key, 5); err != ErrQuotaExhausted {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Key != key {
+		t.Fatal(events)
+	}
+	if err := keym.ConsumeN("", key, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := keym.Consume("", key); err != ErrQuotaExhausted {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatal(events)
+	}
+}
+
+func TestKeyspaceEvent(t *testing.T) {
+	keym := &Keyman{Keypre: "keyser"}
+	var events []Event
+	keym.Subscribe(func(ev Event) {
+		events = append(events, ev)
+	})
+
+	keym.keyspaceEvent("keyserorg-acme", "set")
+	keym.keyspaceEvent("keyserorg-acme", "expired")
+	keym.keyspaceEvent("keyserpool-shared", "del")
+	if len(events) != 2 {
+		t.Fatalf("events %v", events)
+	}
+	if events[0].Type != EventOrgExpired || events[0].Target != "acme" {
+		t.Error(events[0])
+	}
+	if events[1].Type != EventCountersRemoved || events[1].Target != "shared" {
+		t.Error(events[1])
+	}
+}
+
+func TestTraceAuthorize(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	keym := &Keyman{
+		TokenCache: gcache.New(10).LRU().Build(),
+		Tracer:     tp.Tracer("test"),
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(keym.TraceRequests())
+	router.GET("/api/", func(c *gin.Context) {
+		d, err := keym.Authorize(c.Request.Context(), Credentials{Token: "secret-token"}, "/api/")
+		if err != nil || d.Allow {
+			t.Error(d, err)
+		}
+		c.Status(http.StatusUnauthorized)
+	})
+	req := httptest.NewRequest("GET", "/api/", nil)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exp.GetSpans()
+	if len(spans) != 3 {
+		t.Fatal(len(spans))
+	}
+	byName := make(map[string]tracetest.SpanStub)
+	for _, s := range spans {
+		if s.SpanContext.TraceID().String() != "0af7651916cd43dd8448eb211c80319c" {
+			t.Error("trace not continued", s.Name)
+		}
+		for _, a := range s.Attributes {
+			if a.Value.Emit() == "secret-token" {
+				t.Error("token recorded", s.Name)
+			}
+		}
+		byName[s.Name] = s
+	}
+	authorize, ok := byName["keyman.Authorize"]
+	if !ok {
+		t.Fatal(byName)
+	}
+	attrs := make(map[string]string)
+	for _, a := range authorize.Attributes {
+		attrs[string(a.Key)] = a.Value.Emit()
+	}
+	if attrs["keyman.outcome"] != "deny" || attrs["keyman.code"] != ErrTokenInvalid.Code || attrs["keyman.credentials"] != "token" {
+		t.Fatal(attrs)
+	}
+	if byName["keyman.LookupToken"].Parent.SpanID() != authorize.SpanContext.SpanID() {
+		t.Fatal("lookup not under authorize")
+	}
+	if authorize.Parent.SpanID() != byName["GET /api/"].SpanContext.SpanID() {
+		t.Fatal("authorize not under request")
+	}
+}
+
+func TestParseInfo(t *testing.T) {
+	info := "# Server\r\nredis_version:7.2.4\r\nrole:master\r\n\r\n# Memory\r\nused_memory_human:1.02M\r\n"
+	fields := parseInfo(info)
+	if fields["redis_version"] != "7.2.4" || fields["role"] != "master" || fields["used_memory_human"] != "1.02M" {
+		t.Fatal(fields)
+	}
+	if len(fields) != 3 {
+		t.Fatal(fields)
+	}
+}
+
+func TestMountRoutes(t *testing.T) {
+	routes, err := ParseRoutes("key, usage")
+	if err != nil || routes != RoutesOwn|RoutesTokens|RoutesUsage {
+		t.Fatal(routes, err)
+	}
+	if _, err := ParseRoutes("keys,billing"); err == nil {
+		t.Fatal("unknown routes accepted")
+	}
+
+	gin.SetMode(gin.TestMode)
+	keym := new(Keyman)
+	public, admin := gin.New(), gin.New()
+	keym.Mount(public.Group("/api/keys"), RoutesKey)
+	keym.Mount(admin.Group(""), RoutesAdmin)
+	paths := func(router *gin.Engine) map[string]bool {
+		m := make(map[string]bool)
+		for _, r := range router.Routes() {
+			m[r.Path] = true
+		}
+		return m
+	}
+	p, a := paths(public), paths(admin)
+	if !p["/api/keys/getownkey"] || !p["/api/keys/revoketoken"] || p["/api/keys/addkey"] {
+		t.Fatal(p)
+	}
+	if !a["/addkey"] || !a["/revoketoken"] || a["/getownkey"] {
+		t.Fatal(a)
+	}
+
+	all := gin.New()
+	keym.InitHandle(all)
+	if len(all.Routes()) != len(public.Routes())+len(admin.Routes())-1 {
+		t.Fatal(len(all.Routes()))
+	}
+}
+
+// records the commands it is sent, answering none of them
+type recordConn struct {
+	cmds *[][]interface{}
+}
+
+func (c recordConn) Close() error { return nil }
+func (c recordConn) Err() error   { return nil }
+func (c recordConn) Flush() error { return nil }
+func (c recordConn) Receive() (interface{}, error) {
+	return nil, nil
+}
+func (c recordConn) Send(cmd string, args ...interface{}) error {
+	*c.cmds = append(*c.cmds, append([]interface{}{cmd}, args...))
+	return nil
+}
+func (c recordConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "" {
+		c.Send(cmd, args...)
+	}
+	return nil, nil
+}
+
+func TestNamespace(t *testing.T) {
+	var cmds [][]interface{}
+	keym := &Keyman{
+		Keypre:    "keyser",
+		Namespace: "acme",
+		RedisPool: &redis.Pool{Dial: func() (redis.Conn, error) {
+			return recordConn{&cmds}, nil
+		}},
+	}
+	keym.GetQuota("/api", "k1")
+	keym.clearExpiry(keym.redisConn(), "k1")
+	if len(cmds) == 0 {
+		t.Fatal("no commands")
+	}
+	for _, cmd := range cmds {
+		if cmd[0] == "MULTI" || cmd[0] == "EXEC" {
+			continue
+		}
+		for _, arg := range cmd[1:2] {
+			if s, _ := arg.(string); !strings.HasPrefix(s, "acme:") {
+				t.Error("outside the namespace:", cmd)
+			}
+		}
+	}
+	if keym.rkey("keys") != "acme:keys" || (&Keyman{}).rkey("keys") != "keys" {
+		t.Fatal("rkey")
+	}
+	keym.HashTag = true
+	if keym.rkey("keys") != "{acme}:keys" {
+		t.Fatal("rkey")
+	}
+}
+
+// newTestKeyman is a Keyman on an in-memory Redis that runs its scripts
+func newTestKeyman(t *testing.T) (*Keyman, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	keym := &Keyman{
+		Keypre:     "keyser",
+		TokenCache: gcache.New(100).LRU().Build(),
+		TokenTime:  time.Minute,
+		RedisPool: &redis.Pool{Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", mr.Addr())
+		}},
+	}
+	return keym, mr
+}
+
+// testAPI calls the routes of a Keyman with a management key
+type testAPI struct {
+	t      *testing.T
+	router *gin.Engine
+	man    string
+}
+
+func newTestAPI(t *testing.T, keym *Keyman, mr *miniredis.Miniredis) testAPI {
+	k, _ := crypto.GenerateKey()
+	man := k.D.String()
+	mr.HSet(keym.rkey("mkeys"), man, "admin")
+	router := gin.New()
+	keym.InitHandle(router)
+	return testAPI{t, router, man}
+}
+
+// post sends body as JSON, the form values of a route go in its query
+func (a testAPI) post(route string, body interface{}) (int, map[string]interface{}) {
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest("POST", DefaultPrefix+route, bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("key", a.man)
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, req)
+	var ret map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &ret)
+	return w.Code, ret
+}
+
+// mustPost is post for the calls a test sets things up with
+func (a testAPI) mustPost(route string, body interface{}) map[string]interface{} {
+	code, ret := a.post(route, body)
+	if code != http.StatusOK {
+		a.t.Fatal(route, code, ret)
+	}
+	return ret
+}
+
+// addKey creates and enables a key with number units
+func (a testAPI) addKey(number int64) string {
+	key := a.mustPost("/addkey", HKey{Name: "test"})["key"].(string)
+	a.mustPost("/enable", Key{Key: key, Expday: 1, Number: number})
+	return key
+}
+
+// getToken issues a token for key from a /token route
+func getToken(keym *Keyman, key string) (int, string) {
+	router := gin.New()
+	router.POST("/token", keym.GetToken)
+	req := httptest.NewRequest("POST", "/token", nil)
+	req.Header.Set("key", key)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Code, w.Header().Get("token")
+}
+
+func TestConcurrentLease(t *testing.T) {
+	keym, _ := newTestKeyman(t)
+	keym.MaxConcurrent = 2
+	keym.LeaseTime = 50 * time.Millisecond
+
+	l1, err := keym.AcquireConcurrent("", "k1")
+	if err != nil || l1 == "" {
+		t.Fatal(l1, err)
+	}
+	_, err = keym.AcquireConcurrent("", "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = keym.AcquireConcurrent("", "k1")
+	if err != ErrTooManyConcurrent {
+		t.Fatal(err)
+	}
+	// other keys and routes have slots of their own
+	if _, err = keym.AcquireConcurrent("", "k2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = keym.AcquireConcurrent("/api", "k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = keym.ReleaseConcurrent("", "k1", l1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = keym.AcquireConcurrent("", "k1"); err != nil {
+		t.Fatal("slot not released:", err)
+	}
+
+	// the leases of crashed requests expire
+	time.Sleep(2 * keym.LeaseTime)
+	for i := 0; i < 2; i++ {
+		if _, err = keym.AcquireConcurrent("", "k1"); err != nil {
+			t.Fatal("lease not expired:", err)
+		}
+	}
+}
+
+func TestConcurrentHold(t *testing.T) {
+	keym, _ := newTestKeyman(t)
+	keym.MaxConcurrent = 1
+	keym.LeaseTime = 60 * time.Millisecond
+
+	lease, err := keym.AcquireConcurrent("", "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := keym.HoldConcurrent("", "k1", lease)
+	// a request that runs past LeaseTime keeps its slot
+	time.Sleep(4 * keym.LeaseTime)
+	if _, err = keym.AcquireConcurrent("", "k1"); err != ErrTooManyConcurrent {
+		t.Fatal("held lease expired:", err)
+	}
+	release()
+	if _, err = keym.AcquireConcurrent("", "k1"); err != nil {
+		t.Fatal("slot not released:", err)
+	}
+}
+
+func TestConcurrentLimit(t *testing.T) {
+	keym, _ := newTestKeyman(t)
+	keym.MaxConcurrent = 1
+	router := gin.New()
+	router.GET("/anon/:id", keym.ConcurrentLimit(true), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	router.GET("/item/:id", func(c *gin.Context) {
+		setIdentity(c, &Identity{Key: "k1"})
+	}, keym.ConcurrentLimit(true), func(c *gin.Context) {
+		// the route template is the slot, not the path
+		_, err := keym.AcquireConcurrent("/item/:id", "k1")
+		if err != ErrTooManyConcurrent {
+			t.Error(err)
+		}
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/anon/1", nil)
+	req.Header.Set("key", "random")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal("no identity:", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/item/1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestOrgDebit(t *testing.T) {
+	keym, mr := newTestKeyman(t)
+	api := newTestAPI(t, keym, mr)
+	key := api.addKey(10)
+	for _, org := range []string{"o1", "o2"} {
+		api.mustPost("/addorg", HOrg{Org: org, Name: org})
+		api.mustPost("/enableorg", Org{Org: org, Expday: 1, Number: 2})
+	}
+	if code, _ := api.post("/setkeyorg?key="+key+"&org=none", nil); code != http.StatusNotFound {
+		t.Fatal("moved into a missing org:", code)
+	}
+	api.mustPost("/setkeyorg?key="+key+"&org=o1", nil)
+
+	// the org runs out first, and then nothing is debited from the key
+	for i := 0; i < 2; i++ {
+		if err := keym.Consume("", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := keym.CheckKey(key); err != ErrOrgQuotaExhausted {
+		t.Fatal(err)
+	}
+	if err := keym.Consume("", key); err != ErrQuotaExhausted {
+		t.Fatal(err)
+	}
+	if n, _ := mr.Get(keym.keyAddPre(key)); n != "8" {
+		t.Fatal("key debited without its org:", n)
+	}
+
+	// moving the key charges the new org only
+	api.mustPost("/setkeyorg?key="+key+"&org=o2", nil)
+	if err := keym.Consume("", key); err != nil {
+		t.Fatal(err)
+	}
+	n1, _ := mr.Get(keym.keyAddPre(genOrgKey("o1")))
+	n2, _ := mr.Get(keym.keyAddPre(genOrgKey("o2")))
+	if n1 != "0" || n2 != "1" {
+		t.Fatal(n1, n2)
+	}
+	api.mustPost("/setkeyorg?key="+key+"&org=", nil)
+	if org, _ := keym.GetKeyOrg(key); org != "" {
+		t.Fatal(org)
+	}
+	if err := keym.Consume("", key); err != nil {
+		t.Fatal("detached key charged to an org:", err)
+	}
+}
+
+func TestOrgPathDebit(t *testing.T) {
+	keym, mr := newTestKeyman(t)
+	api := newTestAPI(t, keym, mr)
+	key := api.addKey(10)
+	api.mustPost("/addorg", HOrg{Org: "o1", Name: "o1"})
+	api.mustPost("/enableorg", Org{Org: "o1", Expday: 1, Number: 10})
+	api.mustPost("/setkeyorg?key="+key+"&org=o1", nil)
+	api.mustPost("/addcount?key="+key+"&reqpath=/api&count=3", nil)
+
+	// an org without a path counter does not limit the path
+	if err := keym.DecPathKeyCount("/api", key); err != nil {
+		t.Fatal(err)
+	}
+	api.mustPost("/addorgcount?org=o1&reqpath=/api&count=1", nil)
+	if err := keym.Consume("/api", key); err != nil {
+		t.Fatal(err)
+	}
+	// org, key and path levels are debited together or not at all
+	for _, name := range []string{keym.keyAddPre(key), keym.keyAddPre(genOrgKey("o1")), genCountKey("/api", key)} {
+		before, _ := mr.Get(name)
+		if err := keym.Consume("/api", key); err != ErrQuotaExhausted {
+			t.Fatal(err)
+		}
+		if err := keym.DecPathKeyCount("/api", key); err != ErrQuotaExhausted {
+			t.Fatal(err)
+		}
+		if after, _ := mr.Get(name); after != before {
+			t.Fatal(name, before, after)
+		}
+	}
+	if err := keym.CheckPathKeyCount("/api", key); err != ErrOrgQuotaExhausted {
+		t.Fatal(err)
+	}
+
+	// the key path level alone denies as well
+	api.mustPost("/addorgcount?org=o1&reqpath=/api&count=5", nil)
+	if err := keym.DecPathKeyCount("/api", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := keym.DecPathKeyCount("/api", key); err != ErrQuotaExhausted {
+		t.Fatal(err)
+	}
+	if n, _ := mr.Get(genCountKey("/api", genOrgKey("o1"))); n != "4" {
+		t.Fatal("org path debited without the key:", n)
+	}
+}
+
+func TestNamespaceDebit(t *testing.T) {
+	keym, mr := newTestKeyman(t)
+	keym.Namespace = "acme"
+	api := newTestAPI(t, keym, mr)
+	key := api.addKey(10)
+	api.mustPost("/addcount?key="+key+"&reqpath=/api&count=1", nil)
+	if err := keym.DecPathKeyCount("/api", key); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := mr.Get(keym.rkey(genCountKey("/api", key))); n != "0" {
+		t.Fatal("path counter not debited:", n)
+	}
+	if mr.Exists(genCountKey("/api", key)) {
+		t.Fatal("debit outside the namespace")
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	keym, mr := newTestKeyman(t)
+	keym.TransferMaxLen = 2
+	api := newTestAPI(t, keym, mr)
+	from, to := api.addKey(10), api.addKey(5)
+	balance := func(name string) int64 {
+		n, _ := mr.Get(name)
+		v, _ := strconv.ParseInt(n, 10, 64)
+		return v
+	}
+	total := func() int64 {
+		return balance(keym.keyAddPre(from)) + balance(keym.keyAddPre(to))
+	}
+
+	ret := api.mustPost("/transfer?from="+from+"&to="+to+"&count=4", nil)
+	if ret["from"] != 6.0 || ret["to"] != 9.0 || total() != 15 {
+		t.Fatal(ret, total())
+	}
+	// more than the source has is refused, and nothing moves
+	if code, _ := api.post("/transfer?from="+from+"&to="+to+"&count=7", nil); code != http.StatusConflict {
+		t.Fatal("overdrawn:", code)
+	}
+	if code, _ := api.post("/transfer?from="+from+"&to="+to+"&count=-1", nil); code != http.StatusBadRequest {
+		t.Fatal("negative count:", code)
+	}
+	if balance(keym.keyAddPre(from)) != 6 || total() != 15 {
+		t.Fatal(balance(keym.keyAddPre(from)), total())
+	}
+
+	// a missing source counter is refused, a missing target path counter
+	// is created
+	if code, _ := api.post("/transfer?from="+from+"&to="+to+"&count=1&reqpath=/api", nil); code != http.StatusConflict {
+		t.Fatal("missing source:", code)
+	}
+	if mr.Exists(genCountKey("/api", to)) {
+		t.Fatal("target created for a refused transfer")
+	}
+	api.mustPost("/addcount?key="+from+"&reqpath=/api&count=3", nil)
+	api.mustPost("/transfer?from="+from+"&to="+to+"&count=3&reqpath=/api", nil)
+	if balance(genCountKey("/api", from)) != 0 || balance(genCountKey("/api", to)) != 3 {
+		t.Fatal(balance(genCountKey("/api", from)), balance(genCountKey("/api", to)))
+	}
+	if code, _ := api.post("/transfer?from="+from+"&to=nokey&count=1", nil); code != http.StatusNotFound {
+		t.Fatal("missing key:", code)
+	}
+
+	// the log keeps the last TransferMaxLen transfers
+	api.mustPost("/transfer?from="+from+"&to="+to+"&count=1", nil)
+	if n, _ := mr.List(keym.rkey("transfers")); len(n) != 2 {
+		t.Fatal(len(n))
+	}
+	if total() != 15 {
+		t.Fatal(total())
+	}
+
+	// a failure of the store is not a conflict
+	mr.HSet(genCountKey("/bad", from), "a", "1")
+	if code, _ := api.post("/transfer?from="+from+"&to="+to+"&count=1&reqpath=/bad", nil); code != http.StatusInternalServerError {
+		t.Fatal("wrong type:", code)
+	}
+}
+
+func TestTokenConsume(t *testing.T) {
+	keym, mr := newTestKeyman(t)
+	api := newTestAPI(t, keym, mr)
+	key := api.addKey(3)
+	api.mustPost("/addcount?key="+key+"&reqpath=/token/api&count=1", nil)
+	_, token := getToken(keym, key)
+
+	cred := Credentials{Token: token}
+	d, err := keym.Authorize(context.Background(), cred, "/token/api", WithConsume(), WithPathQuota())
+	if err != nil || !d.Allow {
+		t.Fatal(d, err)
+	}
+	if d.Identity.Token == nil || d.Identity.Quota == nil || d.Identity.Key != key {
+		t.Fatal(d.Identity)
+	}
+	if n, _ := mr.Get(keym.keyAddPre(key)); n != "2" {
+		t.Fatal("token call not metered:", n)
+	}
+	// the path quota of the token route is checked like that of a key
+	d, err = keym.Authorize(context.Background(), cred, "/token/api", WithConsume(), WithPathQuota())
+	if err != nil || d.Allow || d.Err.Code != ErrQuotaExhausted.Code {
+		t.Fatal(d, err)
+	}
+	if n, _ := mr.Get(keym.keyAddPre(key)); n != "2" {
+		t.Fatal(n)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	keym, mr := newTestKeyman(t)
+	api := newTestAPI(t, keym, mr)
+	key := api.addKey(10)
+	// keys added before keyaddrs was kept have no entry
+	mr.HDel(keym.rkey("keyaddrs"), KeyToAddrStr(key))
+
+	body := []byte(`{"a":1}`)
+	cred, err := SignRequest(StrToPriv(key), "POST", "/api", body, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.ContentHash != BodyHash(body) || cred.Nonce == "" {
+		t.Fatal(cred)
+	}
+	d, err := keym.Authorize(context.Background(), cred, "/api")
+	if err != nil || !d.Allow || d.Identity.Key != key {
+		t.Fatal(d, err)
+	}
+	if mr.HGet(keym.rkey("keyaddrs"), KeyToAddrStr(key)) != key {
+		t.Fatal("keyaddrs not filled in")
+	}
+
+	// a signature is good for one request
+	d, err = keym.Authorize(context.Background(), cred, "/api")
+	if err != nil || d.Allow || d.Err != ErrSignatureReplayed {
+		t.Fatal(d, err)
+	}
+
+	// nor does it cover another method, body or route
+	for _, change := range []func(c *Credentials) string{
+		func(c *Credentials) string { c.Method = "DELETE"; return "/api" },
+		func(c *Credentials) string { c.ContentHash = BodyHash(nil); return "/api" },
+		func(c *Credentials) string { return "/admin" },
+		func(c *Credentials) string { c.Nonce = ""; return "/api" },
+	} {
+		cred, _ = SignRequest(StrToPriv(key), "POST", "/api", body, time.Now())
+		route := change(&cred)
+		d, err = keym.Authorize(context.Background(), cred, route)
+		if err != nil || d.Allow {
+			t.Fatal(cred, route, d, err)
+		}
+	}
+
+	cred, _ = SignRequest(StrToPriv(key), "POST", "/api", body, time.Now().Add(-time.Hour))
+	d, err = keym.Authorize(context.Background(), cred, "/api")
+	if err != nil || d.Allow || d.Err != ErrSignatureExpired {
+		t.Fatal(d, err)
+	}
+}
+
+func TestGetTokenInvalidKey(t *testing.T) {
+	keym, mr := newTestKeyman(t)
+	api := newTestAPI(t, keym, mr)
+	disabled, expired, exhausted := api.addKey(10), api.addKey(10), api.addKey(0)
+	if code, token := getToken(keym, disabled); code != http.StatusOK || token == "" {
+		t.Fatal(code, token)
+	}
+	issued := keym.TokenCache.Len(true)
+
+	api.mustPost("/diskey", HKey{Key: disabled})
+	mr.FastForward(49 * time.Hour)
+	for _, key := range []string{disabled, expired, exhausted} {
+		if code, token := getToken(keym, key); code == http.StatusOK || token != "" {
+			t.Fatal(code, token)
+		}
+	}
+	if keym.TokenCache.Len(true) != issued {
+		t.Fatal("token cached for an invalid key")
+	}
+}
+
+func TestGetTokenRoute(t *testing.T) {
+	keym, mr := newTestKeyman(t)
+	api := newTestAPI(t, keym, mr)
+	key := api.addKey(10)
+	router := gin.New()
+	router.POST("/app/token", keym.GetToken)
+	getToken := func(route string) (int, string) {
+		req := httptest.NewRequest("POST", "/app/token?route="+route, nil)
+		req.Header.Set("key", key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code, w.Header().Get("token")
+	}
+
+	// only a gateway hands out tokens for routes outside the token path
+	if code, token := getToken("/"); code != http.StatusBadRequest || token != "" {
+		t.Fatal(code, token)
+	}
+	keym.TokenRoutes = true
+	code, token := getToken("/api/")
+	if code != http.StatusOK {
+		t.Fatal(code)
+	}
+	if _, err := keym.LookupToken(token, "/api/items"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keym.LookupToken(token, "/app/token"); err != ErrRouteDenied {
+		t.Fatal(err)
+	}
+}
+
+// the audit entries of action, oldest first
+func auditEntries(t *testing.T, keym *Keyman, action string) []*AuditEntry {
+	redisConn := keym.redisConn()
+	defer redisConn.Close()
+	values, err := redis.Values(redisConn.Do("XRANGE", keym.rkey("audit"), "-", "+"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []*AuditEntry
+	for _, v := range values {
+		entry, err := parseAuditEntry(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Action == action {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestAuditedChanges(t *testing.T) {
+	keym, mr := newTestKeyman(t)
+	api := newTestAPI(t, keym, mr)
+	key := api.addKey(10)
+	api.mustPost("/addpool", HPool{Pool: "p1", Name: "p1"})
+	api.mustPost("/setkeypool?key="+key+"&pool=p1", nil)
+	api.mustPost("/setpolicy?key="+key, nil)
+	mr.Set(keym.rkey(genOverdraftKey(key)), "3")
+	api.mustPost("/resetoverdraft?key="+key, nil)
+	api.mustPost("/diskey", HKey{Key: key})
+	api.mustPost("/delkey", HKey{Key: key})
+	if code, _ := api.post("/delwebhook?id=none", nil); code != http.StatusNotFound {
+		t.Fatal(code)
+	}
+
+	for _, action := range []string{"addkey", "setkeypool", "setpolicy", "resetoverdraft", "diskey", "delkey"} {
+		e := auditEntries(t, keym, action)
+		if len(e) != 1 || e[0].Target != KeyToAddrStr(key) {
+			t.Fatal(action, e)
+		}
+	}
+	if e := auditEntries(t, keym, "resetoverdraft"); e[0].Before != `{"overdraftused":3}` {
+		t.Fatal(e[0])
+	}
+	if e := auditEntries(t, keym, "diskey"); e[0].After != `{"name":"test","number":0,"sec":0}` {
+		t.Fatal(e[0])
+	}
+	if len(auditEntries(t, keym, "delwebhook")) != 0 {
+		t.Fatal("audited a webhook that does not exist")
+	}
+
+	// a deleted key leaves nothing behind
+	for _, name := range []string{"keys", "keypools", "policies"} {
+		if mr.HGet(keym.rkey(name), keym.keyAddPre(key)) != "" {
+			t.Fatal(name)
+		}
+	}
+	if mr.HGet(keym.rkey("keyaddrs"), KeyToAddrStr(key)) != "" || mr.Exists(keym.rkey(genExpiryKey(EventKeyExpired, key))) {
+		t.Fatal("key left behind")
+	}
+}
+
+func TestListAuditCount(t *testing.T) {
+	keym, mr := newTestKeyman(t)
+	api := newTestAPI(t, keym, mr)
+	for i := 0; i < maxListCount+1; i++ {
+		mr.XAdd(keym.rkey("audit"), "*", []string{"action", "enable"})
+	}
+
+	req := httptest.NewRequest("GET", DefaultPrefix+"/listaudit?count=5000", nil)
+	req.Header.Set("key", api.man)
+	w := httptest.NewRecorder()
+	api.router.ServeHTTP(w, req)
+	var ret struct {
+		Entries []*AuditEntry `json:"entries"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &ret)
+	if w.Code != http.StatusOK || len(ret.Entries) != maxListCount {
+		t.Fatal(w.Code, len(ret.Entries))
+	}
+}
+
+func TestAuditedCounters(t *testing.T) {
+	keym, mr := newTestKeyman(t)
+	api := newTestAPI(t, keym, mr)
+	from, to := api.addKey(10), api.addKey(0)
+	if e := auditEntries(t, keym, "enable"); len(e) != 2 || !strings.Contains(e[0].After, `"number":10`) {
+		t.Fatal(e)
+	}
+
+	api.mustPost("/addcount?key="+from+"&reqpath=/api&count=3", nil)
+	api.mustPost("/addcount?key="+from+"&reqpath=/api&count=2", nil)
+	e := auditEntries(t, keym, "addcount")
+	var before, after map[string]interface{}
+	json.Unmarshal([]byte(e[1].Before), &before)
+	json.Unmarshal([]byte(e[1].After), &after)
+	if len(e) != 2 || before["number"] != 3.0 || after["number"] != 5.0 || after["total"] != 5.0 || after["reqpath"] != "/api" {
+		t.Fatal(e[1])
+	}
+
+	// a counter that cannot be incremented leaves no entry, nor does a
+	// refused transfer
+	mr.Set(genTotalCountKey("/bad", from), "x")
+	if code, _ := api.post("/addcount?key="+from+"&reqpath=/bad&count=1", nil); code == http.StatusOK {
+		t.Fatal(code)
+	}
+	if n, _ := mr.Get(genCountKey("/bad", from)); n != "" || len(auditEntries(t, keym, "addcount")) != 2 {
+		t.Fatal("counter changed or audited without the other:", n)
+	}
+	api.post("/transfer?from="+from+"&to="+to+"&count=11", nil)
+	if e := auditEntries(t, keym, "transfer"); len(e) != 0 {
+		t.Fatal(e)
+	}
+
+	api.mustPost("/transfer?from="+from+"&to="+to+"&count=4", nil)
+	e = auditEntries(t, keym, "transfer")
+	if len(e) != 1 || e[0].Target != KeyToAddrStr(from) || !strings.Contains(e[0].After, `"number":6`) || !strings.Contains(e[0].Before, `"number":10`) {
+		t.Fatal(e)
+	}
+}
@@ -12,8 +12,10 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -21,6 +23,7 @@ var Logger *zap.SugaredLogger
 
 var HOSTURL string
 var KEY string
+var PREFIX string
 
 func main() {
 	app := cli.NewApp()
@@ -45,6 +48,12 @@ func main() {
 			Usage:       "server key",
 			Destination: &KEY,
 		},
+		cli.StringFlag{
+			Name:        "prefix",
+			Value:       "/keymem",
+			Usage:       "path the server mounts its routes under",
+			Destination: &PREFIX,
+		},
 	}
 	app.Commands = []cli.Command{
 		{
@@ -239,22 +248,1418 @@ func main() {
 			},
 		},
 		{
-			Name:     "getkeyexpdate",
-			Usage:    "get key expdate",
+			Name:     "setconcurrent",
+			Usage:    "set key max concurrent requests",
 			Category: "manage",
-			Action:   getkeyexpdate,
+			Action:   setconcurrent,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "hkey, hk",
+					Value: "1",
+					Usage: "key for set",
+				},
+				cli.IntFlag{
+					Name:  "limit",
+					Value: 10,
+					Usage: "max in-flight requests, 0 is unlimited",
+				},
+			},
+		},
+		{
+			Name:     "addorg",
+			Usage:    "add org",
+			Category: "manage",
+			Action:   addorg,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "org",
+					Value: "1",
+					Usage: "org id",
+				},
+				cli.StringFlag{
+					Name:  "orgname, on",
+					Value: "org",
+					Usage: "org name",
+				},
+			},
+		},
+		{
+			Name:     "delorg",
+			Usage:    "del org",
+			Category: "manage",
+			Action:   delorg,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "org",
+					Value: "1",
+					Usage: "org id",
+				},
+			},
+		},
+		{
+			Name:     "enableorg",
+			Usage:    "enable org",
+			Category: "manage",
+			Action:   enableorg,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "org",
+					Value: "1",
+					Usage: "org id",
+				},
+				cli.StringFlag{
+					Name:  "day",
+					Value: "10",
+					Usage: "Time limit",
+				},
+				cli.StringFlag{
+					Name:  "num",
+					Value: "10",
+					Usage: "Limit of times",
+				},
+			},
+		},
+		{
+			Name:     "getorg",
+			Usage:    "get org",
+			Category: "manage",
+			Action:   getorg,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "org",
+					Value: "1",
+					Usage: "org id",
+				},
+			},
+		},
+		{
+			Name:     "listorg",
+			Usage:    "list orgs",
+			Category: "manage",
+			Action:   listorg,
+		},
+		{
+			Name:     "setkeyorg",
+			Usage:    "move key to org, empty org detaches it",
+			Category: "manage",
+			Action:   setkeyorg,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "hkey, hk",
+					Value: "1",
+					Usage: "key for move",
+				},
+				cli.StringFlag{
+					Name:  "org",
+					Value: "",
+					Usage: "org id",
+				},
+			},
+		},
+		{
+			Name:     "addorgcount",
+			Usage:    "add org path count",
+			Category: "manage",
+			Action:   addorgcount,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "org",
+					Value: "1",
+					Usage: "org id",
+				},
+				cli.StringFlag{
+					Name:  "reqpath",
+					Value: "/test",
+					Usage: "uri path",
+				},
+				cli.IntFlag{
+					Name:  "count",
+					Value: 10,
+					Usage: "quota for use",
+				},
+			},
+		},
+		{
+			Name:     "addpool",
+			Usage:    "add quota pool",
+			Category: "manage",
+			Action:   addpool,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "pool",
+					Value: "1",
+					Usage: "pool id",
+				},
+				cli.StringFlag{
+					Name:  "poolname, pn",
+					Value: "pool",
+					Usage: "pool name",
+				},
+			},
+		},
+		{
+			Name:     "addpoolcount",
+			Usage:    "add pool count",
+			Category: "manage",
+			Action:   addpoolcount,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "pool",
+					Value: "1",
+					Usage: "pool id",
+				},
+				cli.IntFlag{
+					Name:  "count",
+					Value: 10,
+					Usage: "quota for use",
+				},
+			},
+		},
+		{
+			Name:     "getpool",
+			Usage:    "get pool",
+			Category: "manage",
+			Action:   getpool,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "pool",
+					Value: "1",
+					Usage: "pool id",
+				},
+			},
+		},
+		{
+			Name:     "setkeypool",
+			Usage:    "let key draw from pool, empty pool detaches it",
+			Category: "manage",
+			Action:   setkeypool,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "hkey, hk",
+					Value: "1",
+					Usage: "key for set",
+				},
+				cli.StringFlag{
+					Name:  "pool",
+					Value: "",
+					Usage: "pool id",
+				},
+			},
+		},
+		{
+			Name:     "transfer",
+			Usage:    "transfer quota between keys",
+			Category: "manage",
+			Action:   transfer,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Value: "1",
+					Usage: "source key",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Value: "1",
+					Usage: "target key",
+				},
+				cli.StringFlag{
+					Name:  "reqpath",
+					Value: "",
+					Usage: "uri path, empty for key counter",
+				},
+				cli.IntFlag{
+					Name:  "count",
+					Value: 10,
+					Usage: "units to move",
+				},
+			},
+		},
+		{
+			Name:     "listtransfer",
+			Usage:    "list quota transfers",
+			Category: "manage",
+			Action:   listtransfer,
+		},
+		{
+			Name:     "setpolicy",
+			Usage:    "set key soft limit and overdraft",
+			Category: "manage",
+			Action:   setpolicy,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "hkey, hk",
+					Value: "1",
+					Usage: "key for policy",
+				},
+				cli.IntFlag{
+					Name:  "soft",
+					Value: 0,
+					Usage: "remaining number that warns of a low balance",
+				},
+				cli.IntFlag{
+					Name:  "overdraft",
+					Value: 0,
+					Usage: "units allowed past zero",
+				},
+			},
+		},
+		{
+			Name:     "getpolicy",
+			Usage:    "get key policy",
+			Category: "manage",
+			Action:   getpolicy,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "hkey, hk",
+					Value: "1",
+					Usage: "key for policy",
+				},
+			},
+		},
+		{
+			Name:     "resetoverdraft",
+			Usage:    "get and reset key overdraft used",
+			Category: "manage",
+			Action:   resetoverdraft,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "hkey, hk",
+					Value: "1",
+					Usage: "key for policy",
+				},
+			},
+		},
+		{
+			Name:     "usage",
+			Usage:    "get key usage",
+			Category: "manage",
+			Action:   usage,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "hkey, hk",
+					Value: "1",
+					Usage: "key to query",
+				},
+				cli.StringFlag{
+					Name:  "res",
+					Value: "hour",
+					Usage: "minute, hour or day",
+				},
+				cli.StringFlag{
+					Name:  "group",
+					Value: "",
+					Usage: "group by route, status or route,status",
+				},
+				cli.IntFlag{
+					Name:  "from",
+					Value: 0,
+					Usage: "start unix time, default a day before to",
+				},
+				cli.IntFlag{
+					Name:  "to",
+					Value: 0,
+					Usage: "end unix time, default now",
+				},
+			},
+		},
+		{
+			Name:     "ownusage",
+			Usage:    "get own key usage",
+			Category: "manage",
+			Action:   ownusage,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "res",
+					Value: "hour",
+					Usage: "minute, hour or day",
+				},
+				cli.StringFlag{
+					Name:  "group",
+					Value: "",
+					Usage: "group by route, status or route,status",
+				},
+				cli.IntFlag{
+					Name:  "from",
+					Value: 0,
+					Usage: "start unix time, default a day before to",
+				},
+				cli.IntFlag{
+					Name:  "to",
+					Value: 0,
+					Usage: "end unix time, default now",
+				},
+			},
+		},
+		{
+			Name:     "listaudit",
+			Usage:    "list or export the audit log",
+			Category: "manage",
+			Action:   listaudit,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "count",
+					Value: 100,
+					Usage: "entries to list",
+				},
+				cli.StringFlag{
+					Name:  "action",
+					Value: "",
+					Usage: "only this action, like enable or delkey",
+				},
+				cli.StringFlag{
+					Name:  "target",
+					Value: "",
+					Usage: "only this key, key address, org or pool",
+				},
+				cli.StringFlag{
+					Name:  "before",
+					Value: "",
+					Usage: "only entries before this id, for paging",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "jsonl to export one entry per line",
+				},
+			},
+		},
+		{
+			Name:     "addwebhook",
+			Usage:    "add webhook",
+			Category: "manage",
+			Action:   addwebhook,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: "webhook id, generated when empty",
+				},
+				cli.StringFlag{
+					Name:  "url",
+					Value: "",
+					Usage: "url to post events to",
+				},
+				cli.StringFlag{
+					Name:  "secret",
+					Value: "",
+					Usage: "secret the payload is signed with",
+				},
+				cli.StringFlag{
+					Name:  "events",
+					Value: "",
+					Usage: "comma separated events, all when empty",
+				},
+			},
+		},
+		{
+			Name:     "delwebhook",
+			Usage:    "delete webhook",
+			Category: "manage",
+			Action:   delwebhook,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: "webhook id",
+				},
+			},
+		},
+		{
+			Name:     "listwebhook",
+			Usage:    "list webhooks",
+			Category: "manage",
+			Action:   listwebhook,
 		},
+		{
+			Name:     "listdelivery",
+			Usage:    "list webhook deliveries",
+			Category: "manage",
+			Action:   listdelivery,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "count",
+					Value: 100,
+					Usage: "deliveries to list",
+				},
+				cli.BoolFlag{
+					Name:  "dead",
+					Usage: "list the dead letters",
+				},
+			},
+		},
+		{
+			Name:     "revoketoken",
+			Usage:    "revoke token",
+			Category: "manage",
+			Action:   revoketoken,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "token",
+					Value: "",
+					Usage: "token to revoke",
+				},
+			},
+		},
+		{
+			Name:     "diag",
+			Usage:    "report version, config and store state",
+			Category: "manage",
+			Action:   diag,
+		},
+		{
+			Name:     "setcertkey",
+			Usage:    "authenticate a client certificate as key, by fingerprint or subject",
+			Category: "manage",
+			Action:   setcertkey,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "hkey, hk",
+					Value: "1",
+					Usage: "key for set",
+				},
+				cli.StringFlag{
+					Name:  "fingerprint",
+					Value: "",
+					Usage: "sha256 fingerprint of the certificate",
+				},
+				cli.StringFlag{
+					Name:  "subject",
+					Value: "",
+					Usage: "subject of the certificate",
+				},
+			},
+		},
+		{
+			Name:     "delcertkey",
+			Usage:    "remove a client certificate",
+			Category: "manage",
+			Action:   delcertkey,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "fingerprint",
+					Value: "",
+					Usage: "sha256 fingerprint of the certificate",
+				},
+				cli.StringFlag{
+					Name:  "subject",
+					Value: "",
+					Usage: "subject of the certificate",
+				},
+			},
+		},
+		{
+			Name:     "listcertkey",
+			Usage:    "list client certificates and their keys",
+			Category: "manage",
+			Action:   listcertkey,
+		},
+		{
+			Name:     "getkeyexpdate",
+			Usage:    "get key expdate",
+			Category: "manage",
+			Action:   getkeyexpdate,
+		},
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func listkey(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/listkey"
+	req, err := http.NewRequest("GET", murl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func addmemkey(c *cli.Context) error {
+	raddr := c.String("raddr")
+	rpass := c.String("rpass")
+	hkey := c.String("hkey")
+	hkeyname := c.String("hkeyname")
+	con, err := redis.Dial("tcp", raddr,
+		redis.DialPassword(rpass),
+		redis.DialDatabase(0),
+		redis.DialConnectTimeout(3*time.Second),
+		redis.DialReadTimeout(3*time.Second),
+		redis.DialWriteTimeout(3*time.Second))
+	if err != nil {
+		return err
+	}
+
+	_, err = con.Do("HSET", "mkeys", hkey, hkeyname)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("ok")
+	return nil
+}
+
+func addkey(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/addkey"
+	var b bytes.Buffer
+	var key keyman.HKey
+	key.Key = c.String("hkey")
+	key.Name = c.String("hkeyname")
+	bj, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	b.Write(bj)
+	req, err := http.NewRequest("POST", murl, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func enablekey(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/enable"
+	var b bytes.Buffer
+	var key keyman.Key
+	key.Key = c.String("hkey")
+	key.Expday = c.Int("day")
+	key.Number = c.Int64("num")
+	bj, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	b.Write(bj)
+	req, err := http.NewRequest("POST", murl, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func getkey(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/getkey"
+	var b bytes.Buffer
+	var key keyman.HKey
+	key.Key = c.String("hkey")
+	bj, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	b.Write(bj)
+	req, err := http.NewRequest("POST", murl, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func diskey(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/diskey"
+	var b bytes.Buffer
+	var key keyman.HKey
+	key.Key = c.String("hkey")
+	bj, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	b.Write(bj)
+	req, err := http.NewRequest("POST", murl, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func delkey(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/delkey"
+	var b bytes.Buffer
+	var key keyman.HKey
+	key.Key = c.String("hkey")
+	bj, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	b.Write(bj)
+	req, err := http.NewRequest("POST", murl, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func gettoken(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	req, err := http.NewRequest("PUT", murl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	fmt.Println(res.Header.Get("token"))
+	return nil
+}
+
+func keyaddr(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/keyaddr"
+	req, err := http.NewRequest("GET", murl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func getownkey(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/getownkey"
+	req, err := http.NewRequest("GET", murl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func addcount(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/addcount"
+
+	key := c.String("hkey")
+	reqpath := c.String("reqpath")
+	count := c.Int("count")
+
+	method := "POST"
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	_ = writer.WriteField("key", key)
+	_ = writer.WriteField("reqpath", reqpath)
+	_ = writer.WriteField("count", strconv.Itoa(count))
+	err := writer.Close()
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest(method, murl, payload)
+
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("key", KEY)
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func addtotlecount(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/addtotlecount"
+
+	key := c.String("hkey")
+	reqpath := c.String("reqpath")
+	count := c.Int("count")
+
+	method := "POST"
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	_ = writer.WriteField("key", key)
+	_ = writer.WriteField("reqpath", reqpath)
+	_ = writer.WriteField("count", strconv.Itoa(count))
+	err := writer.Close()
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest(method, murl, payload)
+
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("key", KEY)
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func getcount(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/getcount"
+
+	reqpath := c.String("reqpath")
+
+	method := "POST"
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	_ = writer.WriteField("reqpath", reqpath)
+	err := writer.Close()
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest(method, murl, payload)
+
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("key", KEY)
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func getkeyexpdate(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/getkeyexpdate"
+	req, err := http.NewRequest("GET", murl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func setconcurrent(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/setconcurrent"
+
+	key := c.String("hkey")
+	limit := c.Int("limit")
+
+	method := "POST"
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	_ = writer.WriteField("key", key)
+	_ = writer.WriteField("limit", strconv.Itoa(limit))
+	err := writer.Close()
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest(method, murl, payload)
+
+	if err != nil {
+		return err
+	}
+	req.Header.Add("key", KEY)
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func addorg(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/addorg"
+	var b bytes.Buffer
+	var org keyman.HOrg
+	org.Org = c.String("org")
+	org.Name = c.String("orgname")
+	bj, err := json.Marshal(org)
+	if err != nil {
+		return err
+	}
+	b.Write(bj)
+	req, err := http.NewRequest("POST", murl, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func delorg(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/delorg"
+	var b bytes.Buffer
+	var org keyman.HOrg
+	org.Org = c.String("org")
+	bj, err := json.Marshal(org)
+	if err != nil {
+		return err
+	}
+	b.Write(bj)
+	req, err := http.NewRequest("POST", murl, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func enableorg(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/enableorg"
+	var b bytes.Buffer
+	var org keyman.Org
+	org.Org = c.String("org")
+	org.Expday = c.Int("day")
+	org.Number = c.Int64("num")
+	bj, err := json.Marshal(org)
+	if err != nil {
+		return err
+	}
+	b.Write(bj)
+	req, err := http.NewRequest("POST", murl, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func getorg(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/getorg"
+	var b bytes.Buffer
+	var org keyman.HOrg
+	org.Org = c.String("org")
+	bj, err := json.Marshal(org)
+	if err != nil {
+		return err
+	}
+	b.Write(bj)
+	req, err := http.NewRequest("POST", murl, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func listorg(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/listorg"
+	req, err := http.NewRequest("GET", murl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func setkeyorg(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/setkeyorg"
+
+	key := c.String("hkey")
+	org := c.String("org")
+
+	method := "POST"
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	_ = writer.WriteField("key", key)
+	_ = writer.WriteField("org", org)
+	err := writer.Close()
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest(method, murl, payload)
+
+	if err != nil {
+		return err
+	}
+	req.Header.Add("key", KEY)
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func addorgcount(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/addorgcount"
+
+	org := c.String("org")
+	reqpath := c.String("reqpath")
+	count := c.Int("count")
+
+	method := "POST"
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	_ = writer.WriteField("org", org)
+	_ = writer.WriteField("reqpath", reqpath)
+	_ = writer.WriteField("count", strconv.Itoa(count))
+	err := writer.Close()
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest(method, murl, payload)
+
+	if err != nil {
+		return err
+	}
+	req.Header.Add("key", KEY)
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func addpool(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/addpool"
+	var b bytes.Buffer
+	var pool keyman.HPool
+	pool.Pool = c.String("pool")
+	pool.Name = c.String("poolname")
+	bj, err := json.Marshal(pool)
+	if err != nil {
+		return err
+	}
+	b.Write(bj)
+	req, err := http.NewRequest("POST", murl, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func addpoolcount(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/addpoolcount"
+
+	pool := c.String("pool")
+	count := c.Int("count")
+
+	method := "POST"
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	_ = writer.WriteField("pool", pool)
+	_ = writer.WriteField("count", strconv.Itoa(count))
+	err := writer.Close()
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest(method, murl, payload)
+
+	if err != nil {
+		return err
+	}
+	req.Header.Add("key", KEY)
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func getpool(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/getpool"
+	var b bytes.Buffer
+	var pool keyman.HPool
+	pool.Pool = c.String("pool")
+	bj, err := json.Marshal(pool)
+	if err != nil {
+		return err
+	}
+	b.Write(bj)
+	req, err := http.NewRequest("POST", murl, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func setkeypool(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/setkeypool"
+
+	key := c.String("hkey")
+	pool := c.String("pool")
+
+	method := "POST"
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	_ = writer.WriteField("key", key)
+	_ = writer.WriteField("pool", pool)
+	err := writer.Close()
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest(method, murl, payload)
+
+	if err != nil {
+		return err
+	}
+	req.Header.Add("key", KEY)
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
 	}
+	fmt.Println(string(body))
+	return nil
+}
 
-	err := app.Run(os.Args)
+func transfer(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/transfer"
+
+	from := c.String("from")
+	to := c.String("to")
+	reqpath := c.String("reqpath")
+	count := c.Int("count")
+
+	method := "POST"
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	_ = writer.WriteField("from", from)
+	_ = writer.WriteField("to", to)
+	_ = writer.WriteField("reqpath", reqpath)
+	_ = writer.WriteField("count", strconv.Itoa(count))
+	err := writer.Close()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest(method, murl, payload)
+
+	if err != nil {
+		return err
+	}
+	req.Header.Add("key", KEY)
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
 	}
+	fmt.Println(string(body))
+	return nil
 }
 
-func listkey(c *cli.Context) error {
+func listtransfer(c *cli.Context) error {
 	murl := c.GlobalString("surl")
-	murl = murl + "/keymem/listkey"
+	murl = murl + PREFIX + "/listtransfer"
 	req, err := http.NewRequest("GET", murl, nil)
 	if err != nil {
 		return err
@@ -275,54 +1680,80 @@ func listkey(c *cli.Context) error {
 	return nil
 }
 
-func addmemkey(c *cli.Context) error {
-	raddr := c.String("raddr")
-	rpass := c.String("rpass")
-	hkey := c.String("hkey")
-	hkeyname := c.String("hkeyname")
-	con, err := redis.Dial("tcp", raddr,
-		redis.DialPassword(rpass),
-		redis.DialDatabase(0),
-		redis.DialConnectTimeout(3*time.Second),
-		redis.DialReadTimeout(3*time.Second),
-		redis.DialWriteTimeout(3*time.Second))
+func setpolicy(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/setpolicy"
+
+	key := c.String("hkey")
+	soft := c.Int("soft")
+	overdraft := c.Int("overdraft")
+
+	method := "POST"
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	_ = writer.WriteField("key", key)
+	_ = writer.WriteField("soft", strconv.Itoa(soft))
+	_ = writer.WriteField("overdraft", strconv.Itoa(overdraft))
+	err := writer.Close()
 	if err != nil {
 		return err
 	}
 
-	_, err = con.Do("HSET", "mkeys", hkey, hkeyname)
+	client := &http.Client{}
+	req, err := http.NewRequest(method, murl, payload)
+
 	if err != nil {
 		return err
 	}
+	req.Header.Add("key", KEY)
 
-	fmt.Println("ok")
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
 	return nil
 }
 
-func addkey(c *cli.Context) error {
+func getpolicy(c *cli.Context) error {
 	murl := c.GlobalString("surl")
-	murl = murl + "/keymem/addkey"
-	var b bytes.Buffer
-	var key keyman.HKey
-	key.Key = c.String("hkey")
-	key.Name = c.String("hkeyname")
-	bj, err := json.Marshal(key)
+	murl = murl + PREFIX + "/getpolicy"
+
+	key := c.String("hkey")
+
+	method := "POST"
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	_ = writer.WriteField("key", key)
+	err := writer.Close()
 	if err != nil {
 		return err
 	}
-	b.Write(bj)
-	req, err := http.NewRequest("POST", murl, &b)
+
+	client := &http.Client{}
+	req, err := http.NewRequest(method, murl, payload)
+
 	if err != nil {
 		return err
 	}
-	req.Header.Set("key", KEY)
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
+	req.Header.Add("key", KEY)
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
 	res, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
+
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return err
@@ -331,31 +1762,37 @@ func addkey(c *cli.Context) error {
 	return nil
 }
 
-func enablekey(c *cli.Context) error {
+func resetoverdraft(c *cli.Context) error {
 	murl := c.GlobalString("surl")
-	murl = murl + "/keymem/enable"
-	var b bytes.Buffer
-	var key keyman.Key
-	key.Key = c.String("hkey")
-	key.Expday = c.Int("day")
-	key.Number = c.Int64("num")
-	bj, err := json.Marshal(key)
+	murl = murl + PREFIX + "/resetoverdraft"
+
+	key := c.String("hkey")
+
+	method := "POST"
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	_ = writer.WriteField("key", key)
+	err := writer.Close()
 	if err != nil {
 		return err
 	}
-	b.Write(bj)
-	req, err := http.NewRequest("POST", murl, &b)
+
+	client := &http.Client{}
+	req, err := http.NewRequest(method, murl, payload)
+
 	if err != nil {
 		return err
 	}
-	req.Header.Set("key", KEY)
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
+	req.Header.Add("key", KEY)
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
 	res, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
+
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return err
@@ -364,23 +1801,26 @@ func enablekey(c *cli.Context) error {
 	return nil
 }
 
-func getkey(c *cli.Context) error {
+func usage(c *cli.Context) error {
 	murl := c.GlobalString("surl")
-	murl = murl + "/keymem/getkey"
-	var b bytes.Buffer
-	var key keyman.HKey
-	key.Key = c.String("hkey")
-	bj, err := json.Marshal(key)
-	if err != nil {
-		return err
+	murl = murl + PREFIX + "/usage"
+
+	q := url.Values{}
+	q.Set("usagekey", c.String("hkey"))
+	q.Set("res", c.String("res"))
+	q.Set("group", c.String("group"))
+	if int64(c.Int("from")) > 0 {
+		q.Set("from", strconv.FormatInt(int64(c.Int("from")), 10))
 	}
-	b.Write(bj)
-	req, err := http.NewRequest("POST", murl, &b)
+	if int64(c.Int("to")) > 0 {
+		q.Set("to", strconv.FormatInt(int64(c.Int("to")), 10))
+	}
+
+	req, err := http.NewRequest("GET", murl+"?"+q.Encode(), nil)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("key", KEY)
-	req.Header.Set("Content-Type", "application/json")
 	client := &http.Client{}
 	res, err := client.Do(req)
 	if err != nil {
@@ -395,23 +1835,55 @@ func getkey(c *cli.Context) error {
 	return nil
 }
 
-func diskey(c *cli.Context) error {
+func ownusage(c *cli.Context) error {
 	murl := c.GlobalString("surl")
-	murl = murl + "/keymem/diskey"
-	var b bytes.Buffer
-	var key keyman.HKey
-	key.Key = c.String("hkey")
-	bj, err := json.Marshal(key)
+	murl = murl + PREFIX + "/ownusage"
+
+	q := url.Values{}
+	q.Set("res", c.String("res"))
+	q.Set("group", c.String("group"))
+	if int64(c.Int("from")) > 0 {
+		q.Set("from", strconv.FormatInt(int64(c.Int("from")), 10))
+	}
+	if int64(c.Int("to")) > 0 {
+		q.Set("to", strconv.FormatInt(int64(c.Int("to")), 10))
+	}
+
+	req, err := http.NewRequest("GET", murl+"?"+q.Encode(), nil)
 	if err != nil {
 		return err
 	}
-	b.Write(bj)
-	req, err := http.NewRequest("POST", murl, &b)
+	req.Header.Set("key", KEY)
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func listaudit(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/listaudit"
+
+	q := url.Values{}
+	q.Set("count", strconv.Itoa(c.Int("count")))
+	q.Set("action", c.String("action"))
+	q.Set("target", c.String("target"))
+	q.Set("before", c.String("before"))
+	q.Set("format", c.String("format"))
+
+	req, err := http.NewRequest("GET", murl+"?"+q.Encode(), nil)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("key", KEY)
-	req.Header.Set("Content-Type", "application/json")
 	client := &http.Client{}
 	res, err := client.Do(req)
 	if err != nil {
@@ -426,13 +1898,18 @@ func diskey(c *cli.Context) error {
 	return nil
 }
 
-func delkey(c *cli.Context) error {
+func addwebhook(c *cli.Context) error {
 	murl := c.GlobalString("surl")
-	murl = murl + "/keymem/delkey"
+	murl = murl + PREFIX + "/addwebhook"
 	var b bytes.Buffer
-	var key keyman.HKey
-	key.Key = c.String("hkey")
-	bj, err := json.Marshal(key)
+	var w keyman.Webhook
+	w.ID = c.String("id")
+	w.URL = c.String("url")
+	w.Secret = c.String("secret")
+	if c.String("events") != "" {
+		w.Events = strings.Split(c.String("events"), ",")
+	}
+	bj, err := json.Marshal(w)
 	if err != nil {
 		return err
 	}
@@ -457,32 +1934,48 @@ func delkey(c *cli.Context) error {
 	return nil
 }
 
-func gettoken(c *cli.Context) error {
+func delwebhook(c *cli.Context) error {
 	murl := c.GlobalString("surl")
-	req, err := http.NewRequest("PUT", murl, nil)
+	murl = murl + PREFIX + "/delwebhook"
+
+	id := c.String("id")
+
+	method := "POST"
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	_ = writer.WriteField("id", id)
+	err := writer.Close()
 	if err != nil {
 		return err
 	}
-	req.Header.Set("key", KEY)
-	req.Header.Set("Content-Type", "application/json")
+
 	client := &http.Client{}
+	req, err := http.NewRequest(method, murl, payload)
+
+	if err != nil {
+		return err
+	}
+	req.Header.Add("key", KEY)
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
 	res, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
+
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return err
 	}
 	fmt.Println(string(body))
-	fmt.Println(res.Header.Get("token"))
 	return nil
 }
 
-func keyaddr(c *cli.Context) error {
+func listwebhook(c *cli.Context) error {
 	murl := c.GlobalString("surl")
-	murl = murl + "/keymem/keyaddr"
+	murl = murl + PREFIX + "/listwebhook"
 	req, err := http.NewRequest("GET", murl, nil)
 	if err != nil {
 		return err
@@ -503,15 +1996,21 @@ func keyaddr(c *cli.Context) error {
 	return nil
 }
 
-func getownkey(c *cli.Context) error {
+func listdelivery(c *cli.Context) error {
 	murl := c.GlobalString("surl")
-	murl = murl + "/keymem/getownkey"
-	req, err := http.NewRequest("GET", murl, nil)
+	murl = murl + PREFIX + "/listdelivery"
+
+	q := url.Values{}
+	q.Set("count", strconv.Itoa(c.Int("count")))
+	if c.Bool("dead") {
+		q.Set("dead", "1")
+	}
+
+	req, err := http.NewRequest("GET", murl+"?"+q.Encode(), nil)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("key", KEY)
-	req.Header.Set("Content-Type", "application/json")
 	client := &http.Client{}
 	res, err := client.Do(req)
 	if err != nil {
@@ -526,21 +2025,17 @@ func getownkey(c *cli.Context) error {
 	return nil
 }
 
-func addcount(c *cli.Context) error {
+func revoketoken(c *cli.Context) error {
 	murl := c.GlobalString("surl")
-	murl = murl + "/keymem/addcount"
+	murl = murl + PREFIX + "/revoketoken"
 
-	key := c.String("hkey")
-	reqpath := c.String("reqpath")
-	count := c.Int("count")
+	token := c.String("token")
 
 	method := "POST"
 
 	payload := &bytes.Buffer{}
 	writer := multipart.NewWriter(payload)
-	_ = writer.WriteField("key", key)
-	_ = writer.WriteField("reqpath", reqpath)
-	_ = writer.WriteField("count", strconv.Itoa(count))
+	_ = writer.WriteField("token", token)
 	err := writer.Close()
 	if err != nil {
 		return err
@@ -552,7 +2047,6 @@ func addcount(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("key", KEY)
 
 	req.Header.Set("Content-Type", writer.FormDataContentType())
@@ -570,21 +2064,44 @@ func addcount(c *cli.Context) error {
 	return nil
 }
 
-func addtotlecount(c *cli.Context) error {
+func diag(c *cli.Context) error {
+	murl := c.GlobalString("surl")
+	murl = murl + PREFIX + "/diag"
+	req, err := http.NewRequest("GET", murl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("key", KEY)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+func setcertkey(c *cli.Context) error {
 	murl := c.GlobalString("surl")
-	murl = murl + "/keymem/addtotlecount"
+	murl = murl + PREFIX + "/setcertkey"
 
 	key := c.String("hkey")
-	reqpath := c.String("reqpath")
-	count := c.Int("count")
+	fingerprint := c.String("fingerprint")
+	subject := c.String("subject")
 
 	method := "POST"
 
 	payload := &bytes.Buffer{}
 	writer := multipart.NewWriter(payload)
 	_ = writer.WriteField("key", key)
-	_ = writer.WriteField("reqpath", reqpath)
-	_ = writer.WriteField("count", strconv.Itoa(count))
+	_ = writer.WriteField("fingerprint", fingerprint)
+	_ = writer.WriteField("subject", subject)
 	err := writer.Close()
 	if err != nil {
 		return err
@@ -596,7 +2113,6 @@ func addtotlecount(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("key", KEY)
 
 	req.Header.Set("Content-Type", writer.FormDataContentType())
@@ -614,17 +2130,19 @@ func addtotlecount(c *cli.Context) error {
 	return nil
 }
 
-func getcount(c *cli.Context) error {
+func delcertkey(c *cli.Context) error {
 	murl := c.GlobalString("surl")
-	murl = murl + "/keymem/getcount"
+	murl = murl + PREFIX + "/delcertkey"
 
-	reqpath := c.String("reqpath")
+	fingerprint := c.String("fingerprint")
+	subject := c.String("subject")
 
 	method := "POST"
 
 	payload := &bytes.Buffer{}
 	writer := multipart.NewWriter(payload)
-	_ = writer.WriteField("reqpath", reqpath)
+	_ = writer.WriteField("fingerprint", fingerprint)
+	_ = writer.WriteField("subject", subject)
 	err := writer.Close()
 	if err != nil {
 		return err
@@ -636,7 +2154,6 @@ func getcount(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("key", KEY)
 
 	req.Header.Set("Content-Type", writer.FormDataContentType())
@@ -654,9 +2171,9 @@ func getcount(c *cli.Context) error {
 	return nil
 }
 
-func getkeyexpdate(c *cli.Context) error {
+func listcertkey(c *cli.Context) error {
 	murl := c.GlobalString("surl")
-	murl = murl + "/keymem/getkeyexpdate"
+	murl = murl + PREFIX + "/listcertkey"
 	req, err := http.NewRequest("GET", murl, nil)
 	if err != nil {
 		return err
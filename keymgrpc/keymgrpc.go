@@ -0,0 +1,168 @@
+// Package keymgrpc protects gRPC servers with keymem keys, tokens and
+// signatures. The full method name is the route, so path quotas are
+// granted per method, e.g. "/pkg.Service/Method". Signature callers sign
+// with keyman.SignRequest(priv, "POST", method, nil, t), messages are not
+// signed.
+package keymgrpc
+
+import (
+	"context"
+	"github.com/shellow/keyman"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net/http"
+)
+
+type options struct {
+	require    []keyman.RequireOption
+	perMessage bool
+}
+
+type Option func(*options)
+
+// WithRequire passes RequireOptions such as keyman.WithPathQuota and
+// keyman.WithConsume to every check.
+func WithRequire(opts ...keyman.RequireOption) Option {
+	return func(o *options) {
+		o.require = append(o.require, opts...)
+	}
+}
+
+// PerMessage checks, and with keyman.WithConsume meters, every message a
+// client streams instead of only the start of the stream.
+func PerMessage() Option {
+	return func(o *options) {
+		o.perMessage = true
+	}
+}
+
+// the gRPC code for the HTTP status keyman reports err with
+func errorCode(err *keyman.Error) codes.Code {
+	switch err.Status {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.PermissionDenied
+	}
+}
+
+func first(md metadata.MD, name string) string {
+	v := md.Get(name)
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
+
+func credentials(ctx context.Context) keyman.Credentials {
+	md, _ := metadata.FromIncomingContext(ctx)
+	// gRPC calls are POSTs, the message is not seen here so it is left
+	// out of the signature, which is made over an empty body
+	return keyman.Credentials{
+		Key:         first(md, "key"),
+		Token:       first(md, "token"),
+		Signature:   first(md, "signature"),
+		Timestamp:   first(md, "timestamp"),
+		Nonce:       first(md, "nonce"),
+		Method:      http.MethodPost,
+		ContentHash: keyman.BodyHash(nil),
+	}
+}
+
+func authorize(ctx context.Context, keym *keyman.Keyman, method string, o *options) (context.Context, error) {
+	d, err := keym.Authorize(ctx, credentials(ctx), method, o.require...)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if !d.Allow {
+		return nil, status.Error(errorCode(d.Err), d.Reason)
+	}
+	return keyman.NewContext(ctx, d.Identity), nil
+}
+
+func UnaryServerInterceptor(keym *keyman.Keyman, opts ...Option) grpc.UnaryServerInterceptor {
+	o := new(options)
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authorize(ctx, keym, info.FullMethod, o)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	keym   *keyman.Keyman
+	method string
+	o      *options
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err != nil || !s.o.perMessage {
+		return err
+	}
+	// the credentials were checked when the stream opened, a signature
+	// is good for one use
+	id, ok := keyman.FromContext(s.ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, keyman.ErrAccessDenied.Message)
+	}
+	d, err := s.keym.AuthorizeIdentity(s.ctx, id, s.method, s.o.require...)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if !d.Allow {
+		return status.Error(errorCode(d.Err), d.Reason)
+	}
+	return nil
+}
+
+func StreamServerInterceptor(keym *keyman.Keyman, opts ...Option) grpc.StreamServerInterceptor {
+	o := new(options)
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	// with per message metering the start of the stream is only checked
+	start := o
+	if o.perMessage {
+		start = new(options)
+		start.require = append(start.require, o.require...)
+		start.require = append(start.require, keyman.WithoutConsume())
+	}
+
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authorize(ss.Context(), keym, info.FullMethod, start)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{
+			ServerStream: ss,
+			ctx:          ctx,
+			keym:         keym,
+			method:       info.FullMethod,
+			o:            o,
+		})
+	}
+}
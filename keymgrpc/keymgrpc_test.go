@@ -0,0 +1,115 @@
+package keymgrpc
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bluele/gcache"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gomodule/redigo/redis"
+	"github.com/shellow/keyman"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCredentials(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"key", "aaa",
+		"signature", "bbb",
+		"timestamp", "123",
+		"content-sha256", "ccc"))
+	cred := credentials(ctx)
+	if cred.Key != "aaa" || cred.Token != "" || cred.Signature != "bbb" || cred.Timestamp != "123" {
+		t.Fatal(cred)
+	}
+	if cred.ContentHash != keyman.BodyHash(nil) {
+		t.Fatal(cred)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	if errorCode(keyman.ErrAccessDenied) != codes.Unauthenticated {
+		t.Fatal("access denied")
+	}
+	if errorCode(keyman.ErrQuotaExhausted) != codes.ResourceExhausted {
+		t.Fatal("Exceed quota of use")
+	}
+	if errorCode(keyman.ErrKeyExpired) != codes.PermissionDenied {
+		t.Fatal("Expiry date")
+	}
+}
+
+// testStream delivers n messages on a stream opened with md
+type testStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	n   int
+}
+
+func (s *testStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testStream) RecvMsg(m interface{}) error {
+	if s.n == 0 {
+		return context.Canceled
+	}
+	s.n--
+	return nil
+}
+
+func TestSignedStream(t *testing.T) {
+	mr := miniredis.RunT(t)
+	keym := &keyman.Keyman{
+		Keypre:     "keyser",
+		TokenCache: gcache.New(10).LRU().Build(),
+		RedisPool: &redis.Pool{Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", mr.Addr())
+		}},
+	}
+	k, _ := crypto.GenerateKey()
+	mr.HSet("keys", keym.Keypre+k.D.String(), "test")
+	mr.Set(keym.Keypre+k.D.String(), "3")
+	mr.SetTTL(keym.Keypre+k.D.String(), time.Hour)
+
+	method := "/pkg.Service/Stream"
+	cred, err := keyman.SignRequest(k, http.MethodPost, method, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"signature", cred.Signature,
+		"timestamp", cred.Timestamp,
+		"nonce", cred.Nonce))
+
+	interceptor := StreamServerInterceptor(keym, PerMessage(), WithRequire(keyman.WithConsume()))
+	var got []codes.Code
+	err = interceptor(nil, &testStream{ctx: ctx, n: 4}, &grpc.StreamServerInfo{FullMethod: method},
+		func(srv interface{}, ss grpc.ServerStream) error {
+			for i := 0; i < 4; i++ {
+				got = append(got, status.Code(ss.RecvMsg(nil)))
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each message is metered, none is taken for a replayed signature
+	if len(got) != 4 || got[0] != codes.OK || got[1] != codes.OK || got[2] != codes.OK || got[3] != codes.ResourceExhausted {
+		t.Fatal(got)
+	}
+	if n, _ := mr.Get(keym.Keypre + k.D.String()); n != "0" {
+		t.Fatal(n)
+	}
+
+	// the signature itself opens one stream only
+	err = interceptor(nil, &testStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: method},
+		func(srv interface{}, ss grpc.ServerStream) error { return nil })
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatal(err)
+	}
+}
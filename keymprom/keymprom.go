@@ -0,0 +1,144 @@
+// Package keymprom exports the work of a Keyman as Prometheus metrics.
+// Labels hold outcomes, error codes, quota paths and Redis commands, never
+// keys, so their number stays bounded.
+package keymprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shellow/keyman"
+	"time"
+)
+
+const namespace = "keymem"
+
+// Collector is a keyman.Observer and a prometheus.Collector.
+type Collector struct {
+	keym *keyman.Keyman
+
+	decisions    *prometheus.CounterVec
+	tokensIssued prometheus.Counter
+	tokenChecks  *prometheus.CounterVec
+	consumed     *prometheus.CounterVec
+	redisLatency *prometheus.HistogramVec
+	redisErrors  *prometheus.CounterVec
+
+	poolActive *prometheus.Desc
+	poolIdle   *prometheus.Desc
+	poolWait   *prometheus.Desc
+}
+
+// New returns a Collector observing keym. It replaces keym.Observer.
+func New(keym *keyman.Keyman) *Collector {
+	c := &Collector{
+		keym: keym,
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_decisions_total",
+			Help:      "Authorization decisions by outcome and reason code.",
+		}, []string{"outcome", "reason"}),
+		tokensIssued: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tokens_issued_total",
+			Help:      "Tokens issued.",
+		}),
+		tokenChecks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "token_checks_total",
+			Help:      "Token lookups by token cache result, hit or miss.",
+		}, []string{"cache"}),
+		consumed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "quota_consumed_total",
+			Help:      "Quota units consumed by path quota route, empty for the key quota only.",
+		}, []string{"route"}),
+		redisLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "redis_command_duration_seconds",
+			Help:      "Latency of Redis commands.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"command"}),
+		redisErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "redis_command_errors_total",
+			Help:      "Redis commands that returned an error.",
+		}, []string{"command"}),
+		poolActive: prometheus.NewDesc(namespace+"_redis_pool_active", "Connections in the Redis pool, in use or idle.", nil, nil),
+		poolIdle:   prometheus.NewDesc(namespace+"_redis_pool_idle", "Idle connections in the Redis pool.", nil, nil),
+		poolWait:   prometheus.NewDesc(namespace+"_redis_pool_wait_total", "Times a caller waited for a Redis pool connection.", nil, nil),
+	}
+	keym.Observer = c
+	return c
+}
+
+// Register observes keym and registers the Collector with reg.
+func Register(keym *keyman.Keyman, reg prometheus.Registerer) (*Collector, error) {
+	c := New(keym)
+	err := reg.Register(c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Collector) Decision(d keyman.Decision, err error) {
+	switch {
+	case err != nil:
+		c.decisions.WithLabelValues("error", keyman.AsError(err).Code).Inc()
+	case d.Allow:
+		c.decisions.WithLabelValues("allow", "").Inc()
+	case d.Err != nil:
+		c.decisions.WithLabelValues("deny", d.Err.Code).Inc()
+	default:
+		c.decisions.WithLabelValues("deny", "").Inc()
+	}
+}
+
+func (c *Collector) TokenIssued() {
+	c.tokensIssued.Inc()
+}
+
+func (c *Collector) TokenChecked(hit bool) {
+	if hit {
+		c.tokenChecks.WithLabelValues("hit").Inc()
+	} else {
+		c.tokenChecks.WithLabelValues("miss").Inc()
+	}
+}
+
+func (c *Collector) Consumed(route string, n int64) {
+	c.consumed.WithLabelValues(route).Add(float64(n))
+}
+
+func (c *Collector) RedisCommand(command string, d time.Duration, err error) {
+	c.redisLatency.WithLabelValues(command).Observe(d.Seconds())
+	if err != nil {
+		c.redisErrors.WithLabelValues(command).Inc()
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.decisions.Describe(ch)
+	c.tokensIssued.Describe(ch)
+	c.tokenChecks.Describe(ch)
+	c.consumed.Describe(ch)
+	c.redisLatency.Describe(ch)
+	c.redisErrors.Describe(ch)
+	ch <- c.poolActive
+	ch <- c.poolIdle
+	ch <- c.poolWait
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.decisions.Collect(ch)
+	c.tokensIssued.Collect(ch)
+	c.tokenChecks.Collect(ch)
+	c.consumed.Collect(ch)
+	c.redisLatency.Collect(ch)
+	c.redisErrors.Collect(ch)
+	if c.keym.RedisPool != nil {
+		stats := c.keym.RedisPool.Stats()
+		ch <- prometheus.MustNewConstMetric(c.poolActive, prometheus.GaugeValue, float64(stats.ActiveCount))
+		ch <- prometheus.MustNewConstMetric(c.poolIdle, prometheus.GaugeValue, float64(stats.IdleCount))
+		ch <- prometheus.MustNewConstMetric(c.poolWait, prometheus.CounterValue, float64(stats.WaitCount))
+	}
+}
@@ -0,0 +1,38 @@
+package keymprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shellow/keyman"
+	"testing"
+	"time"
+)
+
+func TestCollector(t *testing.T) {
+	keym := new(keyman.Keyman)
+	reg := prometheus.NewRegistry()
+	c, err := Register(keym, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keym.Observer != c {
+		t.Fatal("observer not set")
+	}
+
+	c.Decision(keyman.Decision{Allow: true}, nil)
+	c.Decision(keyman.Decision{Err: keyman.ErrQuotaExhausted}, nil)
+	c.TokenChecked(true)
+	c.TokenChecked(false)
+	c.Consumed("/api/", 3)
+	c.RedisCommand("GET", time.Millisecond, nil)
+
+	if v := testutil.ToFloat64(c.decisions.WithLabelValues("deny", "QUOTA_EXHAUSTED")); v != 1 {
+		t.Fatal(v)
+	}
+	if v := testutil.ToFloat64(c.consumed.WithLabelValues("/api/")); v != 3 {
+		t.Fatal(v)
+	}
+	if n, err := testutil.GatherAndCount(reg, "keymem_token_checks_total"); err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/shellow/keyman"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// listen on a host:port, or on the unix socket of "unix:" and its path,
+// replacing the socket a previous run left
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// adminRouter serves routes of keym and the metrics, which tell about
+// every key and tenant.
+func adminRouter(keym *keyman.Keyman, routes keyman.RouteSet) *gin.Engine {
+	router := gin.Default()
+	router.Use(useKeyman(keym), keym.TraceRequests())
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	keym.Mount(router.Group(Conf.Admin.Prefix), routes)
+	return router
+}
+
+// serveAdmin serves routes on Conf.Admin.Addr, without TLS: it is meant
+// for localhost or a unix socket.
+func serveAdmin(routes keyman.RouteSet, serveErr chan<- error) (*http.Server, error) {
+	l, err := listen(Conf.Admin.Addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &http.Server{
+		Handler: routeTenants(func(keym *keyman.Keyman) http.Handler {
+			return adminRouter(keym, routes)
+		}),
+		ReadTimeout:    Conf.HTTP.ReadTimeout,
+		WriteTimeout:   Conf.HTTP.WriteTimeout,
+		IdleTimeout:    Conf.HTTP.IdleTimeout,
+		MaxHeaderBytes: Conf.HTTP.MaxHeaderBytes,
+	}
+	Logger.Info("admin run on ", Conf.Admin.Addr)
+	go func() {
+		serveErr <- s.Serve(l)
+	}()
+	return s, nil
+}
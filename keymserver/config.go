@@ -0,0 +1,406 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shellow/keyman"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix starts the environment variable of every option, followed by
+// its yaml path in upper case, e.g. KEYMEM_REDIS_PASSWORD.
+const envPrefix = "KEYMEM"
+
+// HTTPConfig is the listener. On SIGTERM or SIGINT, requests in flight and
+// pending events get up to ShutdownTimeout to finish. Routes lists the
+// keymem route sets mounted under Prefix, see keyman.ParseRoutes; empty is
+// all of them, or only "key" when the admin routes have a listener.
+type HTTPConfig struct {
+	Addr            string        `yaml:"addr"`
+	Prefix          string        `yaml:"prefix"`
+	Routes          string        `yaml:"routes"`
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes  int           `yaml:"max_header_bytes"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// TLSConfig serves HTTPS when CertFile is set. The certificate is read
+// again once its files change. With ClientCAFile, client certificates are
+// verified, ClientAuth "require" refuses connections without one.
+type TLSConfig struct {
+	CertFile       string        `yaml:"cert_file"`
+	KeyFile        string        `yaml:"key_file"`
+	ClientCAFile   string        `yaml:"client_ca_file"`
+	ClientAuth     string        `yaml:"client_auth"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// AdminConfig serves the Routes sets under Prefix on a listener of their
+// own when Addr is set, to keep them off the public one: a host:port, such
+// as 127.0.0.1:8081, or "unix:" and the path of a socket.
+type AdminConfig struct {
+	Addr   string `yaml:"addr"`
+	Prefix string `yaml:"prefix"`
+	Routes string `yaml:"routes"`
+}
+
+// TenantConfig hosts a Keyman of its own, with every Redis key under
+// Namespace, Name when unset, for requests to one of Hosts or whose
+// tenant_header is Name.
+type TenantConfig struct {
+	Name      string   `yaml:"name"`
+	Namespace string   `yaml:"namespace"`
+	Hosts     []string `yaml:"hosts"`
+}
+
+// RedisConfig connects to the Redis at Addr, or to the master Sentinel
+// finds, or to the nodes of a Cluster. Username is the ACL user of
+// Password. HashTags lays the keys of each tenant out in one Cluster slot,
+// as with Cluster, ahead of a move to one.
+type RedisConfig struct {
+	Addr           string        `yaml:"addr"`
+	Username       string        `yaml:"username"`
+	Password       string        `yaml:"password"`
+	DB             int           `yaml:"db"`
+	MaxIdle        int           `yaml:"max_idle"`
+	MaxActive      int           `yaml:"max_active"`
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	ReadTimeout    time.Duration `yaml:"read_timeout"`
+	WriteTimeout   time.Duration `yaml:"write_timeout"`
+
+	HashTags bool           `yaml:"hash_tags"`
+	TLS      RedisTLSConfig `yaml:"tls"`
+	Sentinel SentinelConfig `yaml:"sentinel"`
+	Cluster  ClusterConfig  `yaml:"cluster"`
+}
+
+// RedisTLSConfig connects over TLS when Enabled, verifying Redis against
+// CAFile, the system roots when unset. CertFile and KeyFile are a client
+// certificate, ServerName the name verified when not that of the address.
+type RedisTLSConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// SentinelConfig asks the Sentinels at Addrs for the address of Master on
+// each new connection. Username and Password are those of the Sentinels,
+// which take the TLS settings of Redis.
+type SentinelConfig struct {
+	Master   string   `yaml:"master"`
+	Addrs    []string `yaml:"addrs"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+}
+
+// ClusterConfig are seed nodes of a Redis Cluster. The keys of each tenant
+// hash to the slot of its namespace, the tenant has a pool to the master
+// of that slot.
+type ClusterConfig struct {
+	Addrs []string `yaml:"addrs"`
+}
+
+// Config is every option of keymserver. It is read from the -config file,
+// then from the environment, then from the flags given, each overriding
+// the one before.
+type Config struct {
+	HTTP  HTTPConfig  `yaml:"http"`
+	TLS   TLSConfig   `yaml:"tls"`
+	Admin AdminConfig `yaml:"admin"`
+	Redis RedisConfig `yaml:"redis"`
+
+	// Namespace is that of the default tenant, which serves requests no
+	// tenant claims; empty keeps the Redis keys of older versions.
+	Namespace    string         `yaml:"namespace"`
+	TenantHeader string         `yaml:"tenant_header"`
+	Tenants      []TenantConfig `yaml:"tenants"`
+
+	Keypre         string        `yaml:"keypre"`
+	TokenCacheSize int           `yaml:"token_cache_size"`
+	TokenTime      time.Duration `yaml:"token_time"`
+	LeaseTime      time.Duration `yaml:"lease_time"`
+	MaxConcurrent  int           `yaml:"max_concurrent"`
+	LegacyErrors   bool          `yaml:"legacy_errors"`
+	ProblemJSON    bool          `yaml:"problem_json"`
+	TransferMaxLen int64         `yaml:"transfer_max_len"`
+
+	Gateway        string `yaml:"gateway"`
+	EnvoyPathQuota bool   `yaml:"envoy_path_quota"`
+	EnvoyCost      int64  `yaml:"envoy_cost"`
+
+	// ForwardPreflight lets CORS preflights through the forward auth
+	// checks without credentials, for upstreams that answer them only.
+	ForwardPreflight bool `yaml:"forward_preflight"`
+
+	Webhooks       int           `yaml:"webhooks"`
+	WebhookDeadLen int64         `yaml:"webhook_dead_len"`
+	ExpiryDays     int           `yaml:"expiry_days"`
+	Keyspace       bool          `yaml:"keyspace"`
+	ConsumeStream  string        `yaml:"consume_stream"`
+	ConsumeMaxLen  int64         `yaml:"consume_max_len"`
+	Trace          string        `yaml:"trace"`
+	ReadyLatency   time.Duration `yaml:"ready_latency"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		HTTP: HTTPConfig{
+			Addr:            ":8080",
+			Prefix:          keyman.DefaultPrefix,
+			ReadTimeout:     5 * time.Second,
+			WriteTimeout:    5 * time.Second,
+			MaxHeaderBytes:  1 << 10,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		TLS: TLSConfig{
+			ClientAuth:     "request",
+			ReloadInterval: 10 * time.Second,
+		},
+		Admin: AdminConfig{
+			Prefix: keyman.DefaultPrefix,
+			Routes: "admin",
+		},
+		Redis: RedisConfig{
+			Addr:           "127.0.0.1:6379",
+			Password:       "passwd",
+			MaxIdle:        20,
+			MaxActive:      100,
+			IdleTimeout:    5 * time.Second,
+			ConnectTimeout: 3 * time.Second,
+			ReadTimeout:    3 * time.Second,
+			WriteTimeout:   3 * time.Second,
+		},
+		Keypre:         "keyser",
+		TokenCacheSize: 2000,
+		TokenTime:      15 * time.Minute,
+		LeaseTime:      time.Minute,
+		TransferMaxLen: 10000,
+		EnvoyCost:      1,
+		WebhookDeadLen: 1000,
+		ExpiryDays:     7,
+		ConsumeMaxLen:  1000000,
+		ReadyLatency:   500 * time.Millisecond,
+	}
+}
+
+// LoadFile reads the options set in the yaml file at path, unknown ones
+// are an error.
+func (conf *Config) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(conf)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("config %s: %v", path, err)
+	}
+	return nil
+}
+
+// LoadEnv reads the options set in the environment.
+func (conf *Config) LoadEnv() error {
+	return loadEnv(envPrefix, reflect.ValueOf(conf).Elem())
+}
+
+func loadEnv(prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := prefix + "_" + strings.ToUpper(t.Field(i).Tag.Get("yaml"))
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			err := loadEnv(name, field)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		err := setField(field, s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, s string) error {
+	switch field.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return errors.New("unsupported option type " + field.Type().String())
+		}
+		var list []string
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				list = append(list, v)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	default:
+		return errors.New("unsupported option type " + field.Type().String())
+	}
+	return nil
+}
+
+// Validate reports every option that is out of range.
+func (conf *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+	check(conf.HTTP.Addr != "", "http.addr is required")
+	check(conf.HTTP.ReadTimeout >= 0, "http.read_timeout must not be negative")
+	check(conf.HTTP.WriteTimeout >= 0, "http.write_timeout must not be negative")
+	check(conf.HTTP.IdleTimeout >= 0, "http.idle_timeout must not be negative")
+	check(conf.HTTP.MaxHeaderBytes >= 0, "http.max_header_bytes must not be negative")
+	check(conf.HTTP.ShutdownTimeout > 0, "http.shutdown_timeout must be positive")
+	check(validPrefix(conf.HTTP.Prefix), "http.prefix must start and not end with /")
+	_, err := keyman.ParseRoutes(conf.HTTP.Routes)
+	check(err == nil, fmt.Sprint("http.routes: ", err))
+	check(validPrefix(conf.Admin.Prefix), "admin.prefix must start and not end with /")
+	adminRoutes, err := keyman.ParseRoutes(conf.Admin.Routes)
+	check(err == nil, fmt.Sprint("admin.routes: ", err))
+	check(conf.Admin.Addr == "" || adminRoutes != 0, "admin.routes is required with admin.addr")
+	check((conf.TLS.CertFile == "") == (conf.TLS.KeyFile == ""), "tls.cert_file and tls.key_file go together")
+	check(conf.TLS.ClientCAFile == "" || conf.TLS.CertFile != "", "tls.client_ca_file needs tls.cert_file")
+	check(conf.TLS.ClientAuth == "request" || conf.TLS.ClientAuth == "require", "tls.client_auth must be request or require")
+	check(conf.TLS.ReloadInterval > 0, "tls.reload_interval must be positive")
+	sentinel, cluster := len(conf.Redis.Sentinel.Addrs) > 0, len(conf.Redis.Cluster.Addrs) > 0
+	check(conf.Redis.Addr != "" || sentinel || cluster, "redis.addr is required")
+	check(conf.Redis.DB >= 0, "redis.db must not be negative")
+	check(!sentinel || !cluster, "redis.sentinel and redis.cluster do not go together")
+	check(sentinel == (conf.Redis.Sentinel.Master != ""), "redis.sentinel.master and redis.sentinel.addrs go together")
+	check(!cluster || conf.Redis.DB == 0, "redis.cluster has db 0 only")
+	check(!(cluster || conf.Redis.HashTags) || conf.Namespace != "", "namespace is required with redis.hash_tags or redis.cluster")
+	check((conf.Redis.TLS.CertFile == "") == (conf.Redis.TLS.KeyFile == ""), "redis.tls.cert_file and redis.tls.key_file go together")
+	check(conf.Redis.MaxIdle >= 0, "redis.max_idle must not be negative")
+	check(conf.Redis.MaxActive >= 0, "redis.max_active must not be negative, 0 is unlimited")
+	check(conf.Redis.MaxActive == 0 || conf.Redis.MaxIdle <= conf.Redis.MaxActive, "redis.max_idle must not be above redis.max_active")
+	check(conf.Redis.IdleTimeout >= 0, "redis.idle_timeout must not be negative")
+	check(conf.Redis.ConnectTimeout > 0, "redis.connect_timeout must be positive")
+	check(conf.Redis.ReadTimeout >= 0, "redis.read_timeout must not be negative")
+	check(conf.Redis.WriteTimeout >= 0, "redis.write_timeout must not be negative")
+	conf.validateTenants(check)
+	check(conf.Keypre != "", "keypre is required")
+	check(conf.TokenCacheSize > 0, "token_cache_size must be positive")
+	check(conf.TokenTime > 0, "token_time must be positive")
+	check(conf.LeaseTime > 0, "lease_time must be positive")
+	check(conf.MaxConcurrent >= 0, "max_concurrent must not be negative, 0 is unlimited")
+	check(conf.TransferMaxLen > 0, "transfer_max_len must be positive")
+	check(conf.EnvoyCost >= 0, "envoy_cost must not be negative")
+	check(conf.Webhooks >= 0, "webhooks must not be negative")
+	check(conf.WebhookDeadLen > 0, "webhook_dead_len must be positive")
+	check(conf.ExpiryDays > 0, "expiry_days must be positive")
+	check(conf.ConsumeMaxLen >= 0, "consume_max_len must not be negative")
+	check(conf.Trace == "" || conf.Trace == "stdout" || conf.Trace == "otlp", "trace must be stdout, otlp or empty")
+	check(conf.ReadyLatency > 0, "ready_latency must be positive")
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (conf *Config) validateTenants(check func(ok bool, problem string)) {
+	names := make(map[string]bool)
+	namespaces := map[string]bool{conf.Namespace: true}
+	hosts := make(map[string]bool)
+	for i, t := range conf.Tenants {
+		field := fmt.Sprintf("tenants[%d]", i)
+		check(t.Name != "", field+".name is required")
+		check(!names[t.Name], field+".name "+t.Name+" is taken")
+		names[t.Name] = true
+		namespace := t.Namespace
+		if namespace == "" {
+			namespace = t.Name
+		}
+		check(!namespaces[namespace], field+".namespace "+namespace+" is taken")
+		namespaces[namespace] = true
+		check(len(t.Hosts) > 0 || conf.TenantHeader != "", field+" needs hosts or tenant_header")
+		for _, host := range t.Hosts {
+			host = strings.ToLower(host)
+			check(!hosts[host], field+".hosts "+host+" is taken")
+			hosts[host] = true
+		}
+	}
+}
+
+// empty or /path
+func validPrefix(prefix string) bool {
+	return prefix == "" || strings.HasPrefix(prefix, "/") && !strings.HasSuffix(prefix, "/")
+}
+
+// Routes returns the route sets of the public and of the admin listener,
+// no admin routes without one.
+func (conf *Config) Routes() (public, admin keyman.RouteSet) {
+	public, _ = keyman.ParseRoutes(conf.HTTP.Routes)
+	if conf.Admin.Addr != "" {
+		admin, _ = keyman.ParseRoutes(conf.Admin.Routes)
+	}
+	if strings.TrimSpace(conf.HTTP.Routes) == "" {
+		public = keyman.RoutesAll
+		if conf.Admin.Addr != "" {
+			public = keyman.RoutesKey
+		}
+	}
+	return public, admin
+}
+
+// Print writes conf as yaml, the passwords hidden.
+func (conf *Config) Print(w io.Writer) error {
+	c := *conf
+	if c.Redis.Password != "" {
+		c.Redis.Password = "********"
+	}
+	if c.Redis.Sentinel.Password != "" {
+		c.Redis.Sentinel.Password = "********"
+	}
+	b, err := yaml.Marshal(&c)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"github.com/shellow/keyman"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keymserver.yaml")
+	err = ioutil.WriteFile(path, []byte("keypre: test\ntoken_time: 30m\nredis:\n  addr: redis:6379\n  db: 2\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := defaultConfig()
+	err = conf.LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("KEYMEM_REDIS_PASSWORD", "s3cret")
+	os.Setenv("KEYMEM_REDIS_DB", "3")
+	os.Setenv("KEYMEM_HTTP_READ_TIMEOUT", "10s")
+	defer os.Unsetenv("KEYMEM_REDIS_PASSWORD")
+	defer os.Unsetenv("KEYMEM_REDIS_DB")
+	defer os.Unsetenv("KEYMEM_HTTP_READ_TIMEOUT")
+	err = conf.LoadEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.Keypre != "test" || conf.TokenTime != 30*time.Minute || conf.Redis.Addr != "redis:6379" {
+		t.Fatal(conf)
+	}
+	if conf.Redis.DB != 3 || conf.Redis.Password != "s3cret" || conf.HTTP.ReadTimeout != 10*time.Second {
+		t.Fatal(conf)
+	}
+	if conf.TokenCacheSize != 2000 {
+		t.Fatal("default lost", conf.TokenCacheSize)
+	}
+	err = conf.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	conf.Print(&b)
+	if strings.Contains(b.String(), "s3cret") || !strings.Contains(b.String(), "token_time: 30m0s") {
+		t.Fatal(b.String())
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keymserver.yaml")
+	ioutil.WriteFile(path, []byte("tokentime: 30m\n"), 0600)
+	if err := defaultConfig().LoadFile(path); err == nil {
+		t.Fatal("unknown option accepted")
+	}
+
+	os.Setenv("KEYMEM_WEBHOOKS", "many")
+	err = defaultConfig().LoadEnv()
+	os.Unsetenv("KEYMEM_WEBHOOKS")
+	if err == nil || !strings.Contains(err.Error(), "KEYMEM_WEBHOOKS") {
+		t.Fatal(err)
+	}
+
+	conf := defaultConfig()
+	conf.TokenCacheSize = 0
+	conf.Trace = "jaeger"
+	err = conf.Validate()
+	if err == nil || !strings.Contains(err.Error(), "token_cache_size") || !strings.Contains(err.Error(), "trace") {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigRoutes(t *testing.T) {
+	conf := defaultConfig()
+	public, admin := conf.Routes()
+	if public != keyman.RoutesAll || admin != 0 {
+		t.Fatal(public, admin)
+	}
+	conf.Admin.Addr = "unix:/tmp/keymem-admin.sock"
+	public, admin = conf.Routes()
+	if public != keyman.RoutesKey || admin != keyman.RoutesAdmin {
+		t.Fatal(public, admin)
+	}
+
+	conf.HTTP.Prefix = "/keymem/"
+	conf.Admin.Routes = "none"
+	err := conf.Validate()
+	if err == nil || !strings.Contains(err.Error(), "http.prefix") || !strings.Contains(err.Error(), "admin.routes") {
+		t.Fatal(err)
+	}
+}
+
+func hasRoute(router *gin.Engine, path string) bool {
+	for _, r := range router.Routes() {
+		if r.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMetricsListener(t *testing.T) {
+	defer func(conf *Config) {
+		Conf = conf
+	}(Conf)
+	Conf = defaultConfig()
+	keym := new(keyman.Keyman)
+	if !hasRoute(publicRouter(keym, keyman.RoutesAll), "/metrics") {
+		t.Fatal("no metrics without an admin listener")
+	}
+
+	Conf.Admin.Addr = "127.0.0.1:8081"
+	public, admin := Conf.Routes()
+	if hasRoute(publicRouter(keym, public), "/metrics") {
+		t.Fatal("metrics public next to an admin listener")
+	}
+	if !hasRoute(adminRouter(keym, admin), "/metrics") {
+		t.Fatal("no metrics on the admin listener")
+	}
+}
+
+func TestConfigRedis(t *testing.T) {
+	os.Setenv("KEYMEM_REDIS_SENTINEL_ADDRS", "sentinel-1:26379, sentinel-2:26379")
+	conf := defaultConfig()
+	err := conf.LoadEnv()
+	os.Unsetenv("KEYMEM_REDIS_SENTINEL_ADDRS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf.Redis.Sentinel.Addrs, []string{"sentinel-1:26379", "sentinel-2:26379"}) {
+		t.Fatal(conf.Redis.Sentinel.Addrs)
+	}
+	err = conf.Validate()
+	if err == nil || !strings.Contains(err.Error(), "redis.sentinel.master") {
+		t.Fatal(err)
+	}
+
+	conf = defaultConfig()
+	conf.Redis.Addr = ""
+	conf.Redis.Cluster.Addrs = []string{"node-1:6379"}
+	err = conf.Validate()
+	if err == nil || !strings.Contains(err.Error(), "namespace is required") || strings.Contains(err.Error(), "redis.addr") {
+		t.Fatal(err)
+	}
+	conf.Namespace = "acme"
+	err = conf.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigExample(t *testing.T) {
+	conf := defaultConfig()
+	err := conf.LoadFile("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conf.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf, defaultConfig()) {
+		t.Fatal("example differs from the defaults")
+	}
+}
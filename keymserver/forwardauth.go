@@ -0,0 +1,135 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/shellow/keyman"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// the request a proxy asks about, from the headers nginx auth_request and
+// Traefik ForwardAuth set
+func forwardedRequest(c *gin.Context) (string, *url.URL) {
+	method := c.GetHeader("X-Original-Method")
+	if method == "" {
+		method = c.GetHeader("X-Forwarded-Method")
+	}
+	uri := c.GetHeader("X-Original-URI")
+	if uri == "" {
+		uri = c.GetHeader("X-Forwarded-Uri")
+	}
+	if method == "" {
+		method = c.Request.Method
+	}
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return method, nil
+	}
+	return method, u
+}
+
+func forwardCredentials(c *gin.Context, method string, u *url.URL) keyman.Credentials {
+	token := c.GetHeader("token")
+	if token == "" {
+		token = u.Query().Get("token")
+	}
+	// the body does not come along, the upstream checks it against
+	// content-sha256
+	return keyman.Credentials{
+		Key:         c.GetHeader("key"),
+		Token:       token,
+		Signature:   c.GetHeader("signature"),
+		Timestamp:   c.GetHeader("timestamp"),
+		Nonce:       c.GetHeader("nonce"),
+		Method:      method,
+		ContentHash: c.GetHeader("content-sha256"),
+	}
+}
+
+// denials are always reported with their status, a proxy only looks at it.
+// nginx takes anything but 401 and 403 as a failure of the check itself, so
+// the others become 403 and the code is kept in a header.
+func forwardDeny(c *gin.Context, err error, nginx bool) {
+	e := keyman.AsError(err)
+	status := e.Status
+	if nginx && status != http.StatusUnauthorized && status != http.StatusForbidden {
+		status = http.StatusForbidden
+	}
+	c.Header("X-Keymem-Error-Code", e.Code)
+	c.AbortWithStatusJSON(status, gin.H{
+		"status":  "error",
+		"code":    e.Code,
+		"message": e.Message,
+	})
+}
+
+func forwardAuth(c *gin.Context, method string, u *url.URL, pathquota bool, cost int64, nginx bool) {
+	if u == nil {
+		forwardDeny(c, keyman.ErrRouteNotFound, nginx)
+		return
+	}
+	// a CORS preflight carries no credentials, it is let through when
+	// forward_preflight is set; any other OPTIONS request is checked
+	if Conf.ForwardPreflight && method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	var opts []keyman.RequireOption
+	reqpath := ""
+	if pathquota {
+		opts = append(opts, keyman.WithPathQuota())
+		reqpath = u.Path
+	}
+
+	keym := keymanOf(c, Keym)
+	d, err := keym.Authorize(c.Request.Context(), forwardCredentials(c, method, u), u.Path, opts...)
+	if err != nil {
+		forwardDeny(c, err, nginx)
+		return
+	}
+	if !d.Allow {
+		forwardDeny(c, d.Err, nginx)
+		return
+	}
+	if cost > 0 {
+		err = keym.ConsumeAs(reqpath, d.Identity, cost)
+		if err != nil {
+			forwardDeny(c, err, nginx)
+			return
+		}
+	}
+
+	if d.Identity.Quota != nil {
+		d.Identity.Quota.SetHeaders(c.Writer.Header())
+	}
+	setIdentityHeaders(c.Writer.Header(), d.Identity)
+	c.Status(http.StatusOK)
+}
+
+// ForwardAuth answers nginx auth_request and Traefik ForwardAuth checks.
+// pathquota=1 checks the path quota of the original path, cost sets the
+// units metered, 0 only checks.
+func ForwardAuth(c *gin.Context) {
+	cost := int64(1)
+	if s := c.Query("cost"); s != "" {
+		var err error
+		cost, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || cost < 0 {
+			forwardDeny(c, &keyman.Error{Code: "BAD_REQUEST", Status: http.StatusBadRequest, Message: "cost error"}, false)
+			return
+		}
+	}
+	method, u := forwardedRequest(c)
+	forwardAuth(c, method, u, c.Query("pathquota") == "1", cost, c.GetHeader("X-Original-URI") != "")
+}
+
+// EnvoyAuth answers the HTTP service of Envoy ext_authz, which sends the
+// original method and headers to path_prefix followed by the original path.
+// The query is the caller's, so the path quota and cost are set with
+// -envoypathquota and -envoycost.
+func EnvoyAuth(c *gin.Context) {
+	u := &url.URL{Path: c.Param("path"), RawQuery: c.Request.URL.RawQuery}
+	forwardAuth(c, c.Request.Method, u, Conf.EnvoyPathQuota, Conf.EnvoyCost, false)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/shellow/keyman"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedRequest(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/auth", nil)
+	c.Request.Header.Set("X-Forwarded-Method", "POST")
+	c.Request.Header.Set("X-Forwarded-Uri", "/api/test?token=aaa")
+	method, u := forwardedRequest(c)
+	if method != "POST" || u.Path != "/api/test" {
+		t.Fatal(method, u)
+	}
+	if cred := forwardCredentials(c, "GET", u); cred.Token != "aaa" {
+		t.Fatal(cred)
+	}
+}
+
+func TestForwardDeny(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	forwardDeny(c, keyman.ErrQuotaExhausted, false)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatal(w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	forwardDeny(c, keyman.ErrQuotaExhausted, true)
+	if w.Code != http.StatusForbidden || w.Header().Get("X-Keymem-Error-Code") != "QUOTA_EXHAUSTED" {
+		t.Fatal(w.Code, w.Header())
+	}
+}
+
+func TestForwardOptions(t *testing.T) {
+	keym, _, _ := testKeyman(t, "10")
+	defer func(keym *keyman.Keyman, conf *Config) {
+		Keym, Conf = keym, conf
+	}(Keym, Conf)
+	Keym, Conf = keym, defaultConfig()
+
+	check := func(preflight bool) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/auth", nil)
+		c.Request.Header.Set("X-Forwarded-Method", "OPTIONS")
+		c.Request.Header.Set("X-Forwarded-Uri", "/api/test")
+		if preflight {
+			c.Request.Header.Set("Origin", "https://app.example")
+			c.Request.Header.Set("Access-Control-Request-Method", "DELETE")
+		}
+		ForwardAuth(c)
+		return w.Code
+	}
+
+	if code := check(false); code != http.StatusUnauthorized {
+		t.Fatal("OPTIONS without a key:", code)
+	}
+	if code := check(true); code != http.StatusUnauthorized {
+		t.Fatal("preflight let through by default:", code)
+	}
+	Conf.ForwardPreflight = true
+	if code := check(false); code != http.StatusUnauthorized {
+		t.Fatal("OPTIONS without a key:", code)
+	}
+	if code := check(true); code != http.StatusOK {
+		t.Fatal("preflight:", code)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/shellow/keyman"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// GatewayRoute sends the requests under Prefix to Upstream. Auth is "key",
+// "token" or "none", tokens for a route are asked for with route=Prefix;
+// with PathQuota the prefix is the path of the quota.
+// Rate caps the calls per second of a key, Concurrent applies the in-flight
+// limit of the key and Cost is the units metered per call, 1 when unset.
+type GatewayRoute struct {
+	Prefix      string `json:"prefix"`
+	Upstream    string `json:"upstream"`
+	Auth        string `json:"auth"`
+	PathQuota   bool   `json:"pathquota"`
+	Rate        int    `json:"rate"`
+	Concurrent  bool   `json:"concurrent"`
+	Cost        int64  `json:"cost"`
+	StripPrefix bool   `json:"stripprefix"`
+}
+
+// GatewayConfig holds the routes. MaxSignedBody caps the body of a signed
+// request, which is read before the check to hash it, 1 MiB when unset.
+type GatewayConfig struct {
+	Routes        []GatewayRoute `json:"routes"`
+	MaxSignedBody int64          `json:"max_signed_body"`
+}
+
+const defaultMaxSignedBody = 1 << 20
+
+type gatewayRoute struct {
+	GatewayRoute
+	proxy *httputil.ReverseProxy
+}
+
+type Gateway struct {
+	keym          *keyman.Keyman
+	routes        []*gatewayRoute
+	maxSignedBody int64
+}
+
+// headers a caller authenticates with, never passed upstream
+var credentialHeaders = []string{"key", "token", "signature", "timestamp", "nonce"}
+
+const identityHeaderPrefix = "X-Keymem-"
+
+// the *Gateway unmatched requests go to, swapped on SIGHUP
+var gateway atomic.Value
+
+// serveGateway proxies a request no route matched through the gateway in
+// effect, without one gin answers 404.
+func serveGateway(c *gin.Context) {
+	gw, _ := gateway.Load().(*Gateway)
+	if gw != nil {
+		gw.Handle(c)
+	}
+}
+
+func LoadGateway(keym *keyman.Keyman, file string) (*Gateway, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	conf := new(GatewayConfig)
+	err = json.Unmarshal(b, conf)
+	if err != nil {
+		return nil, err
+	}
+	return NewGateway(keym, conf)
+}
+
+func NewGateway(keym *keyman.Keyman, conf *GatewayConfig) (*Gateway, error) {
+	gw := &Gateway{keym: keym, maxSignedBody: conf.MaxSignedBody}
+	if gw.maxSignedBody < 0 {
+		return nil, errors.New("max_signed_body must not be negative")
+	}
+	if gw.maxSignedBody == 0 {
+		gw.maxSignedBody = defaultMaxSignedBody
+	}
+	for _, r := range conf.Routes {
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return nil, errors.New("route prefix must start with /: " + r.Prefix)
+		}
+		switch r.Auth {
+		case "":
+			r.Auth = "key"
+		case "key", "token", "none":
+		default:
+			return nil, errors.New("route auth error: " + r.Auth)
+		}
+		if r.Cost == 0 {
+			r.Cost = 1
+		}
+		target, err := url.Parse(r.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		if target.Scheme == "" || target.Host == "" {
+			return nil, errors.New("route upstream error: " + r.Upstream)
+		}
+
+		route := &gatewayRoute{GatewayRoute: r}
+		route.proxy = httputil.NewSingleHostReverseProxy(target)
+		director := route.proxy.Director
+		route.proxy.Director = func(req *http.Request) {
+			if route.StripPrefix {
+				req.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(route.Prefix, "/")), "/")
+				req.URL.RawPath = ""
+			}
+			director(req)
+		}
+		gw.routes = append(gw.routes, route)
+	}
+	// longest prefix first
+	sort.SliceStable(gw.routes, func(i, j int) bool {
+		return len(gw.routes[i].Prefix) > len(gw.routes[j].Prefix)
+	})
+	return gw, nil
+}
+
+// match finds the route of path, a prefix matches whole path segments
+// so "/api" does not take "/apiary"
+func (gw *Gateway) match(path string) *gatewayRoute {
+	for _, r := range gw.routes {
+		prefix := strings.TrimSuffix(r.Prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return r
+		}
+	}
+	return nil
+}
+
+func (gw *Gateway) credentials(c *gin.Context, route *gatewayRoute) (keyman.Credentials, error) {
+	if route.Auth == "token" {
+		token := c.GetHeader("token")
+		if token == "" {
+			token = c.Query("token")
+		}
+		return keyman.Credentials{Token: token}, nil
+	}
+	cred := keyman.Credentials{
+		Key:       c.GetHeader("key"),
+		Signature: c.GetHeader("signature"),
+		Timestamp: c.GetHeader("timestamp"),
+		Nonce:     c.GetHeader("nonce"),
+		Method:    c.Request.Method,
+		Cert:      keyman.PeerCertificate(c.Request.TLS),
+	}
+	// a signature covers the body the upstream gets, not the one claimed
+	if cred.Signature != "" {
+		var body []byte
+		if c.Request.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, gw.maxSignedBody))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return cred, keyman.ErrBodyTooLarge
+			} else if err != nil {
+				return cred, &keyman.Error{Code: "BAD_REQUEST", Status: http.StatusBadRequest, Message: "body error"}
+			}
+			c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		cred.ContentHash = keyman.BodyHash(body)
+	}
+	return cred, nil
+}
+
+// drop the credentials and any identity headers sent by the caller, then
+// add the identity that was checked
+func setUpstreamHeaders(h http.Header, id *keyman.Identity) {
+	for _, name := range credentialHeaders {
+		h.Del(name)
+	}
+	for name := range h {
+		if strings.HasPrefix(name, identityHeaderPrefix) {
+			h.Del(name)
+		}
+	}
+	if id != nil {
+		setIdentityHeaders(h, id)
+	}
+}
+
+func setIdentityHeaders(h http.Header, id *keyman.Identity) {
+	h.Set(identityHeaderPrefix+"Key-Id", id.Address)
+	if id.Name != "" {
+		h.Set(identityHeaderPrefix+"Name", id.Name)
+	}
+	if id.Quota != nil {
+		h.Set(identityHeaderPrefix+"Remaining", strconv.FormatInt(id.Remaining, 10))
+	}
+}
+
+// Handle checks a request for its path, meters it for the route the path
+// falls under, then passes it to the upstream of the route and records the
+// usage.
+func (gw *Gateway) Handle(c *gin.Context) {
+	keym := keymanOf(c, gw.keym)
+	route := gw.match(c.Request.URL.Path)
+	if route == nil {
+		keym.AbortError(c, keyman.ErrRouteNotFound)
+		return
+	}
+
+	var id *keyman.Identity
+	if route.Auth != "none" {
+		var opts []keyman.RequireOption
+		reqpath := ""
+		if route.PathQuota {
+			opts = append(opts, keyman.WithQuotaPath(route.Prefix))
+			reqpath = route.Prefix
+		}
+		cred, err := gw.credentials(c, route)
+		if err != nil {
+			keym.AbortError(c, err)
+			return
+		}
+		d, err := keym.Authorize(c.Request.Context(), cred, c.Request.URL.Path, opts...)
+		if err != nil {
+			keym.AbortError(c, err)
+			return
+		}
+		if !d.Allow {
+			keym.AbortError(c, d.Err)
+			return
+		}
+		id = d.Identity
+
+		err = keym.AllowRate(route.Prefix, id.Key, route.Rate, time.Second)
+		if err != nil {
+			keym.AbortError(c, err)
+			return
+		}
+		if route.Concurrent {
+			lease, err := keym.AcquireConcurrent(route.Prefix, id.Key)
+			if err != nil {
+				keym.AbortError(c, err)
+				return
+			}
+			release := keym.HoldConcurrent(route.Prefix, id.Key, lease)
+			defer release()
+		}
+		err = keym.ConsumeAs(reqpath, id, route.Cost)
+		if err != nil {
+			keym.AbortError(c, err)
+			return
+		}
+	}
+
+	setUpstreamHeaders(c.Request.Header, id)
+	route.proxy.ServeHTTP(c.Writer, c.Request)
+	if id != nil {
+		keym.RecordUsage(id.Key, route.Prefix, c.Writer.Status(), time.Now())
+	}
+}
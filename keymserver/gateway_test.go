@@ -0,0 +1,238 @@
+package main
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bluele/gcache"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"github.com/shellow/keyman"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeyman is a Keyman on an in-memory Redis with one key of number
+// units, returned with it
+func testKeyman(t *testing.T, number string) (*keyman.Keyman, *miniredis.Miniredis, string) {
+	mr := miniredis.RunT(t)
+	keym := &keyman.Keyman{
+		Keypre:     "keyser",
+		TokenCache: gcache.New(100).LRU().Build(),
+		TokenTime:  time.Minute,
+		RedisPool: &redis.Pool{Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", mr.Addr())
+		}},
+	}
+	k, _ := crypto.GenerateKey()
+	key := k.D.String()
+	mr.HSet("keys", keym.Keypre+key, "test")
+	mr.Set(keym.Keypre+key, number)
+	mr.SetTTL(keym.Keypre+key, time.Hour)
+	return keym, mr, key
+}
+
+func TestGatewayProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("key") != "" || r.Header.Get("X-Keymem-Name") != "" {
+			t.Error("credential or identity header passed upstream")
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other" + r.URL.Path))
+	}))
+	defer other.Close()
+
+	gw, err := NewGateway(new(keyman.Keyman), &GatewayConfig{Routes: []GatewayRoute{
+		{Prefix: "/api/", Upstream: upstream.URL, Auth: "none"},
+		{Prefix: "/api/v2/", Upstream: other.URL, Auth: "none", StripPrefix: true},
+		{Prefix: "/files", Upstream: other.URL, Auth: "none", StripPrefix: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.NoRoute(gw.Handle)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for path, want := range map[string]string{
+		"/api/test":    "/api/test",
+		"/api/v2/test": "other/test",
+		"/api/v2":      "other/",
+		"/files":       "other/",
+		"/files/a":     "other/a",
+	} {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Header.Set("key", "aaa")
+		req.Header.Set("X-Keymem-Name", "spoofed")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(body) != want {
+			t.Fatal(path, res.StatusCode, string(body))
+		}
+	}
+
+	// a prefix only matches whole segments
+	for _, path := range []string{"/none", "/filesystem", "/apiary"} {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatal(path, res.StatusCode)
+		}
+	}
+}
+
+func TestGatewayToken(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("token") != "" {
+			t.Error("token passed upstream")
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	keym, mr, key := testKeyman(t, "10")
+	keym.TokenRoutes = true
+	mr.Set("/api/-"+key, "5")
+	gw, err := NewGateway(keym, &GatewayConfig{Routes: []GatewayRoute{
+		{Prefix: "/api/", Upstream: upstream.URL, Auth: "token", PathQuota: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.PUT("/token", keym.GetToken)
+	router.NoRoute(gw.Handle)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	getToken := func(query string) string {
+		req, _ := http.NewRequest("PUT", server.URL+"/token"+query, nil)
+		req.Header.Set("key", key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.StatusCode)
+		}
+		return res.Header.Get("token")
+	}
+	call := func(token string) (int, string) {
+		req, _ := http.NewRequest("GET", server.URL+"/api/items/1", nil)
+		req.Header.Set("token", token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res.StatusCode, string(body)
+	}
+
+	code, body := call(getToken("?route=/api/"))
+	if code != http.StatusOK || body != "/api/items/1" {
+		t.Fatal(code, body)
+	}
+	// metered on the prefix of the route
+	if n, _ := mr.Get(keym.Keypre + key); n != "9" {
+		t.Fatal(n)
+	}
+	if n, _ := mr.Get("/api/-" + key); n != "4" {
+		t.Fatal(n)
+	}
+
+	// a token asked for on /token grants the routes under /token only
+	code, body = call(getToken(""))
+	if code != http.StatusForbidden {
+		t.Fatal(code, body)
+	}
+}
+
+func TestGatewaySignedBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	keym, _, key := testKeyman(t, "10")
+	gw, err := NewGateway(keym, &GatewayConfig{
+		Routes:        []GatewayRoute{{Prefix: "/api/", Upstream: upstream.URL}},
+		MaxSignedBody: 8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.NoRoute(gw.Handle)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	call := func(body string) (int, string) {
+		cred, err := keyman.SignRequest(keym.StrToPriv(key), "POST", "/api/items", []byte(body), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("POST", server.URL+"/api/items", strings.NewReader(body))
+		req.Header.Set("signature", cred.Signature)
+		req.Header.Set("timestamp", cred.Timestamp)
+		req.Header.Set("nonce", cred.Nonce)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res.StatusCode, string(b)
+	}
+
+	if code, body := call("12345678"); code != http.StatusOK || body != "12345678" {
+		t.Fatal(code, body)
+	}
+	if code, body := call("123456789"); code != http.StatusRequestEntityTooLarge {
+		t.Fatal(code, body)
+	}
+}
+
+func TestGatewayConfig(t *testing.T) {
+	for _, r := range []GatewayRoute{
+		{Prefix: "api", Upstream: "http://127.0.0.1:9000"},
+		{Prefix: "/api/", Upstream: "127.0.0.1:9000"},
+		{Prefix: "/api/", Upstream: "http://127.0.0.1:9000", Auth: "basic"},
+	} {
+		if _, err := NewGateway(new(keyman.Keyman), &GatewayConfig{Routes: []GatewayRoute{r}}); err == nil {
+			t.Fatal(r)
+		}
+	}
+}
+
+func TestUpstreamHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("key", "aaa")
+	h.Set("token", "bbb")
+	h.Set("X-Keymem-Key-Id", "spoofed")
+	setUpstreamHeaders(h, &keyman.Identity{Address: "0x01", Name: "test", Remaining: 9, Quota: &keyman.Quota{}})
+	if h.Get("key") != "" || h.Get("token") != "" {
+		t.Fatal(h)
+	}
+	if h.Get("X-Keymem-Key-Id") != "0x01" || h.Get("X-Keymem-Name") != "test" || h.Get("X-Keymem-Remaining") != "9" {
+		t.Fatal(h)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// Healthz answers while the process serves requests.
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz answers 200 once Redis answers within -readylatency and the token
+// store works, 503 otherwise, with the outcome of each check.
+func Readyz(c *gin.Context) {
+	checks := gin.H{}
+	ready := true
+
+	latency, err := keymanOf(c, Keym).Ping(c.Request.Context())
+	switch {
+	case err != nil:
+		checks["store"] = err.Error()
+		ready = false
+	case latency > Conf.ReadyLatency:
+		checks["store"] = "slow: " + latency.String()
+		ready = false
+	default:
+		checks["store"] = "ok"
+	}
+	checks["latency"] = latency.String()
+
+	err = keymanOf(c, Keym).CheckTokenStore()
+	if err != nil {
+		checks["token_store"] = err.Error()
+		ready = false
+	} else {
+		checks["token_store"] = "ok"
+	}
+
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{
+		"status": status,
+		"checks": checks,
+	})
+}
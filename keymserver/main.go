@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"github.com/bluele/gcache"
 	"github.com/gin-gonic/gin"
 	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/shellow/keyman"
+	"github.com/shellow/keyman/keymprom"
 	"go.uber.org/zap"
 	"net/http"
 	"os"
@@ -14,21 +19,102 @@ import (
 
 var Logger *zap.SugaredLogger
 
-var LISTENADDR string
-var RedisAddr string
-var RedisPass string
+var Conf *Config
+var TraceShutdown func(context.Context) error
 var Keym *keyman.Keyman
 
+// the -config file and the flags given, read again on SIGHUP
+var configFile string
+var givenFlags = make(map[string]string)
+
+// ended on shutdown: the goroutines of background and the async work
+// started, each stop flushing what it has pending
+var background, stopBackground = context.WithCancel(context.Background())
+var stops []func()
+
 func main() {
 	initApp()
-	server()
+	err := server()
+	if err != nil {
+		Logger.Error(err)
+		os.Exit(1)
+	}
+}
+
+func bindFlags(fs *flag.FlagSet, conf *Config) {
+	fs.StringVar(&conf.Redis.Password, "rpass", conf.Redis.Password, "redis passwd, better set with KEYMEM_REDIS_PASSWORD")
+	fs.StringVar(&conf.HTTP.Addr, "addr", conf.HTTP.Addr, "listen address")
+	fs.StringVar(&conf.HTTP.Prefix, "prefix", conf.HTTP.Prefix, "path the keymem routes are mounted under")
+	fs.StringVar(&conf.Admin.Addr, "adminaddr", conf.Admin.Addr, "listen address of the admin routes and metrics, host:port or unix:path, empty serves them on -addr")
+	fs.DurationVar(&conf.HTTP.ShutdownTimeout, "shutdowntimeout", conf.HTTP.ShutdownTimeout, "time requests in flight and pending events get to finish on SIGTERM or SIGINT")
+	fs.StringVar(&conf.Redis.Addr, "raddr", conf.Redis.Addr, "redis address")
+	fs.StringVar(&conf.Redis.Username, "ruser", conf.Redis.Username, "redis acl user")
+	fs.IntVar(&conf.Redis.DB, "rdb", conf.Redis.DB, "redis database")
+	fs.StringVar(&conf.Keypre, "keypre", conf.Keypre, "prefix of the redis counters of keys")
+	fs.IntVar(&conf.MaxConcurrent, "maxconc", conf.MaxConcurrent, "max concurrent requests per key, 0 is unlimited")
+	fs.BoolVar(&conf.LegacyErrors, "legacyerr", conf.LegacyErrors, "report errors as 200 with status error, like older versions")
+	fs.BoolVar(&conf.ProblemJSON, "problem", conf.ProblemJSON, "report errors as application/problem+json")
+	fs.StringVar(&conf.Gateway, "gateway", conf.Gateway, "gateway route config, proxy unmatched requests to upstreams, reloaded on SIGHUP")
+	fs.BoolVar(&conf.EnvoyPathQuota, "envoypathquota", conf.EnvoyPathQuota, "envoy ext_authz checks the path quota of the original path")
+	fs.Int64Var(&conf.EnvoyCost, "envoycost", conf.EnvoyCost, "units envoy ext_authz meters per request, 0 only checks")
+	fs.BoolVar(&conf.ForwardPreflight, "forwardpreflight", conf.ForwardPreflight, "let CORS preflights through /auth checks without credentials")
+	fs.IntVar(&conf.Webhooks, "webhooks", conf.Webhooks, "webhook delivery workers, 0 disables webhooks")
+	fs.IntVar(&conf.ExpiryDays, "expirydays", conf.ExpiryDays, "days before expiry a key.expiring event is sent")
+	fs.BoolVar(&conf.Keyspace, "keyspace", conf.Keyspace, "emit events for counters redis expires or deletes, from keyspace notifications")
+	fs.StringVar(&conf.ConsumeStream, "consumestream", conf.ConsumeStream, "redis stream to append a record of every metered call to, empty disables")
+	fs.Int64Var(&conf.ConsumeMaxLen, "consumemaxlen", conf.ConsumeMaxLen, "trim the consume stream to about this many records, 0 keeps all")
+	fs.StringVar(&conf.Trace, "trace", conf.Trace, "export traces to stdout or otlp, set up by the OTEL_EXPORTER_OTLP_* variables, empty disables")
+	fs.DurationVar(&conf.ReadyLatency, "readylatency", conf.ReadyLatency, "slowest redis round trip /readyz accepts")
 }
 
 func initarg() {
-	flag.StringVar(&RedisPass, "rpass", "passwd", "redis passwd")
-	flag.StringVar(&LISTENADDR, "addr", ":8080", "listen address")
-	flag.StringVar(&RedisAddr, "raddr", "127.0.0.1:6379", "redis address")
+	var printConfig bool
+	Conf = defaultConfig()
+	flag.StringVar(&configFile, "config", "", "yaml config file, options are overridden by KEYMEM_* variables and flags")
+	flag.BoolVar(&printConfig, "print-config", false, "print the config in effect and exit")
+	bindFlags(flag.CommandLine, Conf)
 	flag.Parse()
+
+	flag.Visit(func(f *flag.Flag) {
+		givenFlags[f.Name] = f.Value.String()
+	})
+	exitOnConfigError(loadConfig(Conf, flag.CommandLine))
+
+	if printConfig {
+		Conf.Print(os.Stdout)
+		os.Exit(0)
+	}
+}
+
+// flags override the config file and the environment, so they are parsed
+// into the defaults first and given again, through fs, once those are
+// loaded into conf
+func loadConfig(conf *Config, fs *flag.FlagSet) error {
+	*conf = *defaultConfig()
+	if configFile != "" {
+		err := conf.LoadFile(configFile)
+		if err != nil {
+			return err
+		}
+	}
+	err := conf.LoadEnv()
+	if err != nil {
+		return err
+	}
+	for name, value := range givenFlags {
+		if fs.Lookup(name) != nil {
+			fs.Set(name, value)
+		}
+	}
+	return conf.Validate()
+}
+
+// before the logger is set up
+func exitOnConfigError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 }
 
 func initApp() {
@@ -39,64 +125,186 @@ func initApp() {
 	defer logger.Sync()
 	Logger = logger.Sugar()
 
-	// init redis
-	redisPool := &redis.Pool{
-		MaxIdle:     20,
-		MaxActive:   100,
-		IdleTimeout: 5 * time.Second,
-		Wait:        true,
-		Dial: func() (redis.Conn, error) {
-			con, err := redis.Dial("tcp", RedisAddr,
-				redis.DialPassword(RedisPass),
-				redis.DialDatabase(0),
-				redis.DialConnectTimeout(3*time.Second),
-				redis.DialReadTimeout(3*time.Second),
-				redis.DialWriteTimeout(3*time.Second))
+	redisPools, err := newRedisPools(Conf.Redis)
+	if err != nil {
+		Logger.Fatal(err)
+	}
+	Keym = newKeyman(redisPools(Conf.Namespace), Conf.Namespace)
+	for _, t := range Conf.Tenants {
+		namespace := t.Namespace
+		if namespace == "" {
+			namespace = t.Name
+		}
+		Tenants[t.Name] = newKeyman(redisPools(namespace), namespace)
+	}
+
+	// metrics of tenants are told apart by a tenant label, "" for Keym
+	for _, keym := range keymans() {
+		reg := prometheus.DefaultRegisterer
+		if len(Tenants) > 0 {
+			reg = prometheus.WrapRegistererWith(prometheus.Labels{"tenant": tenantName(keym)}, reg)
+		}
+		_, err = keymprom.Register(keym, reg)
+		if err != nil {
+			Logger.Error(err)
+		}
+	}
+
+	if Conf.Trace != "" {
+		exp, err := newSpanExporter(Conf.Trace)
+		if err != nil {
+			Logger.Fatal(err)
+		}
+		TraceShutdown = initTracing(exp)
+	}
+
+	for _, keym := range keymans() {
+		if Conf.Webhooks > 0 {
+			stops = append(stops, keym.StartWebhooks(Conf.Webhooks))
+			go checkExpiry(background, keym)
+		}
+		if Conf.ConsumeStream != "" {
+			stops = append(stops, keym.StartConsumeStream(Conf.ConsumeStream, Conf.ConsumeMaxLen))
+		}
+		if Conf.Keyspace {
+			// in a cluster each tenant may sit on its own node
+			err = keym.EnableKeyspaceEvents()
 			if err != nil {
-				return nil, err
+				Logger.Warn("set notify-keyspace-events: ", err)
 			}
-			return con, nil
-		},
+			go listenKeyspace(background, keym)
+		}
 	}
-	Keym = new(keyman.Keyman)
-	Keym.RedisPool = redisPool
-	Keym.Keypre = "keyser"
-	Keym.TokenCache = gcache.New(2000).LRU().Build()
-	Keym.TokenTime = time.Minute * 15
 
 	Logger.Info("init finish")
 }
 
-func server() {
-	router := gin.Default()
+// newKeyman is a Keyman of Conf with its Redis keys in namespace.
+func newKeyman(redisPool *redis.Pool, namespace string) *keyman.Keyman {
+	keym := new(keyman.Keyman)
+	keym.RedisPool = redisPool
+	keym.Namespace = namespace
+	keym.HashTag = Conf.Redis.HashTags || len(Conf.Redis.Cluster.Addrs) > 0
+	keym.Keypre = Conf.Keypre
+	keym.TokenCache = gcache.New(Conf.TokenCacheSize).LRU().Build()
+	keym.TokenTime = Conf.TokenTime
+	keym.TokenRoutes = Conf.Gateway != ""
+	keym.MaxConcurrent = Conf.MaxConcurrent
+	keym.LeaseTime = Conf.LeaseTime
+	keym.LegacyErrors = Conf.LegacyErrors
+	keym.ProblemJSON = Conf.ProblemJSON
+	keym.TransferMaxLen = Conf.TransferMaxLen
+	keym.WebhookDeadLen = Conf.WebhookDeadLen
+	return keym
+}
 
-	router.GET("/test", func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.String(http.StatusOK, "Hello World")
-	})
-	router.GET("/token/test", func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		if Keym.CheckToken(c) == nil {
+func checkExpiry(ctx context.Context, keym *keyman.Keyman) {
+	for {
+		err := keym.CheckExpiry(time.Duration(Conf.ExpiryDays) * 24 * time.Hour)
+		if err != nil {
+			Logger.Error(err)
+		}
+		select {
+		case <-ctx.Done():
 			return
+		case <-time.After(time.Hour):
 		}
-		c.String(http.StatusOK, "Hello token")
+	}
+}
+
+// listen again after a redis failure, events in between are lost
+func listenKeyspace(ctx context.Context, keym *keyman.Keyman) {
+	for {
+		err := keym.ListenKeyspace(ctx, Conf.Redis.DB)
+		if ctx.Err() != nil {
+			return
+		}
+		Logger.Error(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// server serves until SIGTERM or SIGINT, see waitSignals, the admin
+// routes on a listener of their own when Conf.Admin.Addr is set.
+func server() error {
+	publicRoutes, adminRoutes := Conf.Routes()
+	router := routeTenants(func(keym *keyman.Keyman) http.Handler {
+		return publicRouter(keym, publicRoutes)
 	})
-	router.PUT("/token", Keym.GetToken)
-	router.PUT("/token2", Keym.GetToken)
-	Keym.InitHandle(router)
+	if Conf.Gateway != "" {
+		gw, err := LoadGateway(Keym, Conf.Gateway)
+		if err != nil {
+			return err
+		}
+		gateway.Store(gw)
+	}
 
 	s := &http.Server{
-		Addr:           LISTENADDR,
+		Addr:           Conf.HTTP.Addr,
 		Handler:        router,
-		ReadTimeout:    5 * time.Second,
-		WriteTimeout:   5 * time.Second,
-		MaxHeaderBytes: 1 << 10,
+		ReadTimeout:    Conf.HTTP.ReadTimeout,
+		WriteTimeout:   Conf.HTTP.WriteTimeout,
+		IdleTimeout:    Conf.HTTP.IdleTimeout,
+		MaxHeaderBytes: Conf.HTTP.MaxHeaderBytes,
 	}
 
-	Logger.Info("server run")
-	err := s.ListenAndServe()
-	if err != nil {
-		Logger.Error(err)
-		os.Exit(-1)
+	servers := []*http.Server{s}
+	serveErr := make(chan error, 2)
+	if adminRoutes != 0 {
+		admin, err := serveAdmin(adminRoutes, serveErr)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, admin)
+	}
+	if Conf.TLS.CertFile != "" {
+		var err error
+		s.TLSConfig, certs, err = newTLSConfig(Conf.TLS)
+		if err != nil {
+			return err
+		}
+		Logger.Info("server run with tls")
+		go func() {
+			serveErr <- s.ListenAndServeTLS("", "")
+		}()
+	} else {
+		Logger.Info("server run")
+		go func() {
+			serveErr <- s.ListenAndServe()
+		}()
+	}
+	return waitSignals(servers, serveErr)
+}
+
+// publicRouter serves routes of keym and the checks of proxies, a gateway
+// for the requests left. The metrics are served here unless there is an
+// admin listener.
+func publicRouter(keym *keyman.Keyman, routes keyman.RouteSet) *gin.Engine {
+	router := gin.Default()
+	router.Use(useKeyman(keym), keym.TraceRequests())
+
+	router.GET("/test", func(c *gin.Context) {
+		c.Header("Access-Control-Allow-Origin", "*")
+		c.String(http.StatusOK, "Hello World")
+	})
+	router.GET("/token/test", keym.RequireToken(), keym.UsageRecorder(), keym.ConcurrentLimit(false), func(c *gin.Context) {
+		c.Header("Access-Control-Allow-Origin", "*")
+		c.String(http.StatusOK, "Hello token")
+	})
+	router.PUT("/token", keym.GetToken)
+	router.PUT("/token2", keym.GetToken)
+	if Conf.Admin.Addr == "" {
+		router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	}
+	router.GET("/healthz", Healthz)
+	router.GET("/readyz", Readyz)
+	router.Any("/auth", ForwardAuth)
+	router.Any("/auth/envoy/*path", EnvoyAuth)
+	keym.Mount(router.Group(Conf.HTTP.Prefix), routes)
+	router.NoRoute(serveGateway)
+	return router
 }
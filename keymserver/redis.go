@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisDialOptions are those of a connection to Redis, or to a Sentinel:
+// the timeouts, the ACL user and TLS.
+func redisDialOptions(conf RedisConfig, sentinel bool) ([]redis.DialOption, error) {
+	opts := []redis.DialOption{
+		redis.DialConnectTimeout(conf.ConnectTimeout),
+		redis.DialReadTimeout(conf.ReadTimeout),
+		redis.DialWriteTimeout(conf.WriteTimeout),
+	}
+	username, password := conf.Username, conf.Password
+	if sentinel {
+		username, password = conf.Sentinel.Username, conf.Sentinel.Password
+	} else {
+		opts = append(opts, redis.DialDatabase(conf.DB))
+	}
+	if username != "" {
+		opts = append(opts, redis.DialUsername(username))
+	}
+	if password != "" {
+		opts = append(opts, redis.DialPassword(password))
+	}
+
+	if conf.TLS.Enabled {
+		tlsConfig := &tls.Config{
+			ServerName:         conf.TLS.ServerName,
+			InsecureSkipVerify: conf.TLS.InsecureSkipVerify,
+		}
+		if conf.TLS.CAFile != "" {
+			b, err := ioutil.ReadFile(conf.TLS.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(b) {
+				return nil, errors.New("no certificate in " + conf.TLS.CAFile)
+			}
+		}
+		if conf.TLS.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(conf.TLS.CertFile, conf.TLS.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		opts = append(opts, redis.DialUseTLS(true), redis.DialTLSConfig(tlsConfig))
+	}
+	return opts, nil
+}
+
+// newRedisPools returns the pool of the keys of a namespace: one to
+// conf.Addr or to the master of conf.Sentinel for all of them, or in a
+// cluster one to the master of the slot of each namespace.
+func newRedisPools(conf RedisConfig) (func(namespace string) *redis.Pool, error) {
+	opts, err := redisDialOptions(conf, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(conf.Cluster.Addrs) > 0 {
+		pools := make(map[string]*redis.Pool)
+		return func(namespace string) *redis.Pool {
+			if pools[namespace] == nil {
+				slot := keySlot(namespace)
+				pools[namespace] = newRedisPool(conf, opts, func() (string, error) {
+					return clusterNode(conf.Cluster.Addrs, slot, opts)
+				}, "")
+			}
+			return pools[namespace]
+		}, nil
+	}
+
+	addr := func() (string, error) {
+		return conf.Addr, nil
+	}
+	role := ""
+	if len(conf.Sentinel.Addrs) > 0 {
+		sentinelOpts, err := redisDialOptions(conf, true)
+		if err != nil {
+			return nil, err
+		}
+		addr = func() (string, error) {
+			return sentinelMaster(conf.Sentinel, sentinelOpts)
+		}
+		role = "master"
+	}
+	pool := newRedisPool(conf, opts, addr, role)
+	return func(string) *redis.Pool {
+		return pool
+	}, nil
+}
+
+// newRedisPool dials the address addr returns at the time, checking the
+// server has role when it is set.
+func newRedisPool(conf RedisConfig, opts []redis.DialOption, addr func() (string, error), role string) *redis.Pool {
+	moves := role != "" || len(conf.Cluster.Addrs) > 0
+	return &redis.Pool{
+		MaxIdle:     conf.MaxIdle,
+		MaxActive:   conf.MaxActive,
+		IdleTimeout: conf.IdleTimeout,
+		Wait:        true,
+		Dial: func() (redis.Conn, error) {
+			a, err := addr()
+			if err != nil {
+				return nil, err
+			}
+			con, err := redis.Dial("tcp", a, opts...)
+			if err != nil {
+				return nil, err
+			}
+			if role != "" {
+				err = checkRole(con, role)
+				if err != nil {
+					con.Close()
+					return nil, err
+				}
+			}
+			if moves {
+				return &movedConn{Conn: con}, nil
+			}
+			return con, nil
+		},
+	}
+}
+
+func checkRole(c redis.Conn, role string) error {
+	values, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return errors.New("empty ROLE reply")
+	}
+	got, err := redis.String(values[0], nil)
+	if err != nil {
+		return err
+	}
+	if got != role {
+		return fmt.Errorf("redis is %s, not %s", got, role)
+	}
+	return nil
+}
+
+// sentinelMaster asks the Sentinels in turn for the address of the master.
+func sentinelMaster(conf SentinelConfig, opts []redis.DialOption) (string, error) {
+	var err error
+	for _, addr := range conf.Addrs {
+		var master []string
+		master, err = askSentinel(addr, conf.Master, opts)
+		if err == nil {
+			return net.JoinHostPort(master[0], master[1]), nil
+		}
+	}
+	return "", fmt.Errorf("no sentinel gave master %s: %v", conf.Master, err)
+}
+
+func askSentinel(addr, master string, opts []redis.DialOption) ([]string, error) {
+	c, err := redis.Dial("tcp", addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	reply, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", master))
+	if err == redis.ErrNil {
+		return nil, errors.New(addr + " does not know master " + master)
+	} else if err != nil {
+		return nil, err
+	}
+	if len(reply) != 2 {
+		return nil, errors.New(addr + " gave no address")
+	}
+	return reply, nil
+}
+
+// clusterNode returns the address of the master serving slot, from the
+// first seed node that answers CLUSTER SLOTS.
+func clusterNode(seeds []string, slot int, opts []redis.DialOption) (string, error) {
+	var err error
+	for _, seed := range seeds {
+		var addr string
+		addr, err = askSlot(seed, slot, opts)
+		if err == nil {
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("no cluster node gave slot %d: %v", slot, err)
+}
+
+func askSlot(seed string, slot int, opts []redis.DialOption) (string, error) {
+	c, err := redis.Dial("tcp", seed, opts...)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	ranges, err := redis.Values(c.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return "", err
+	}
+	// each range is start, end, then the master and replicas as ip, port
+	for _, r := range ranges {
+		fields, err := redis.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return "", errors.New("unexpected CLUSTER SLOTS reply")
+		}
+		start, _ := redis.Int(fields[0], nil)
+		end, _ := redis.Int(fields[1], nil)
+		if slot < start || slot > end {
+			continue
+		}
+		master, err := redis.Values(fields[2], nil)
+		if err != nil || len(master) < 2 {
+			return "", errors.New("unexpected CLUSTER SLOTS reply")
+		}
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		if host == "" {
+			// the node did not learn its own address, it is the seed
+			host, _, _ = net.SplitHostPort(seed)
+		}
+		return net.JoinHostPort(host, strconv.Itoa(port)), nil
+	}
+	return "", fmt.Errorf("slot %d not served", slot)
+}
+
+// keySlot is the cluster slot of the keys tagged {tag}.
+func keySlot(tag string) int {
+	var crc uint16
+	for i := 0; i < len(tag); i++ {
+		crc ^= uint16(tag[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return int(crc) % 16384
+}
+
+// movedConn breaks once Redis answers MOVED, from a cluster node that no
+// longer serves the slot, or READONLY, from a master Sentinel demoted. The
+// pool then drops it and dials where the keys are now.
+type movedConn struct {
+	redis.Conn
+	err error
+}
+
+func (c *movedConn) check(err error) {
+	if e, ok := err.(redis.Error); ok {
+		if strings.HasPrefix(string(e), "MOVED ") || strings.HasPrefix(string(e), "READONLY ") {
+			c.err = e
+		}
+	}
+}
+
+func (c *movedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(commandName, args...)
+	c.check(err)
+	return reply, err
+}
+
+func (c *movedConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.check(err)
+	return reply, err
+}
+
+// pubsub and blocking reads wait with these
+
+func (c *movedConn) DoWithTimeout(timeout time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	reply, err := redis.DoWithTimeout(c.Conn, timeout, commandName, args...)
+	c.check(err)
+	return reply, err
+}
+
+func (c *movedConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	reply, err := redis.ReceiveWithTimeout(c.Conn, timeout)
+	c.check(err)
+	return reply, err
+}
+
+func (c *movedConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.Conn.Err()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"testing"
+)
+
+func TestKeySlot(t *testing.T) {
+	// the slots CLUSTER KEYSLOT gives
+	for tag, slot := range map[string]int{"foo": 12182, "bar": 5061, "": 0} {
+		if got := keySlot(tag); got != slot {
+			t.Fatal(tag, got, slot)
+		}
+	}
+}
+
+type replyConn struct {
+	redis.Conn
+	err error
+}
+
+func (c replyConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return nil, c.err
+}
+
+func (c replyConn) Err() error {
+	return nil
+}
+
+func TestMovedConn(t *testing.T) {
+	c := &movedConn{Conn: replyConn{err: redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")}}
+	c.Do("GET", "k")
+	if c.Err() != nil {
+		t.Fatal(c.Err())
+	}
+	c = &movedConn{Conn: replyConn{err: redis.Error("MOVED 3999 127.0.0.1:6381")}}
+	c.Do("GET", "k")
+	if c.Err() == nil {
+		t.Fatal("conn kept after MOVED")
+	}
+}
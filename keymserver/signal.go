@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+)
+
+// waitSignals waits for a server to fail, or for SIGTERM or SIGINT to shut
+// them down; SIGHUP reloads the config.
+func waitSignals(servers []*http.Server, serveErr <-chan error) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case err := <-serveErr:
+			shutdown(servers)
+			return err
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				Logger.Info("reload config")
+				reload()
+				continue
+			}
+			Logger.Info("shutdown on ", sig)
+			return shutdown(servers)
+		}
+	}
+}
+
+// shutdown closes the listeners of servers and waits for the requests in
+// flight, then flushes the events, webhook deliveries and consume records they
+// left, all within Conf.HTTP.ShutdownTimeout.
+func shutdown(servers []*http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), Conf.HTTP.ShutdownTimeout)
+	defer cancel()
+
+	var err error
+	for _, s := range servers {
+		serr := s.Shutdown(ctx)
+		if serr != nil {
+			err = serr
+			Logger.Error("drain requests: ", serr)
+		}
+	}
+	stopBackground()
+
+	flushed := make(chan struct{})
+	go func() {
+		for _, stop := range stops {
+			stop()
+		}
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		err = ctx.Err()
+		Logger.Error("flush pending events: ", err)
+	}
+
+	if TraceShutdown != nil {
+		terr := TraceShutdown(ctx)
+		if terr != nil {
+			Logger.Error("flush traces: ", terr)
+		}
+	}
+	for _, keym := range keymans() {
+		keym.RedisPool.Close()
+	}
+	Logger.Sync()
+	return err
+}
+
+// reload reads the config again and applies what can change while serving:
+// the gateway routes with their costs and rate limits, and the TLS
+// certificate. Keys, pools and policies live in Redis and need no reload.
+// A config that fails to load or validate leaves the one in effect.
+func reload() {
+	next := new(Config)
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	bindFlags(fs, next)
+	err := loadConfig(next, fs)
+	if err != nil {
+		Logger.Error("reload: ", err)
+		return
+	}
+
+	if next.Gateway != "" {
+		gw, err := LoadGateway(Keym, next.Gateway)
+		if err != nil {
+			Logger.Error("reload gateway: ", err)
+			return
+		}
+		gateway.Store(gw)
+	} else {
+		gateway.Store((*Gateway)(nil))
+	}
+
+	if certs != nil {
+		err = certs.Reload()
+		if err != nil {
+			Logger.Error("reload certificate: ", err)
+		}
+	}
+
+	unchanged := *next
+	unchanged.Gateway = Conf.Gateway
+	if !reflect.DeepEqual(&unchanged, Conf) {
+		Logger.Warn("reload: options other than gateway take a restart")
+	}
+	Conf.Gateway = next.Gateway
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadGateway(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	routes := filepath.Join(dir, "gateway.json")
+	writeFile(t, routes, []byte(`{"routes": [{"prefix": "/api/", "upstream": "http://127.0.0.1:9000", "rate": 10, "cost": 2}]}`))
+	configFile = filepath.Join(dir, "keymserver.yaml")
+	writeFile(t, configFile, []byte("gateway: "+routes+"\n"))
+	defer func() { configFile = "" }()
+	Logger = zap.NewNop().Sugar()
+	Conf = defaultConfig()
+	defer gateway.Store((*Gateway)(nil))
+
+	reload()
+	gw, _ := gateway.Load().(*Gateway)
+	if gw == nil || Conf.Gateway != routes {
+		t.Fatal("gateway not loaded")
+	}
+	if r := gw.match("/api/x"); r == nil || r.Cost != 2 || r.Rate != 10 {
+		t.Fatal(r)
+	}
+
+	writeFile(t, routes, []byte(`{"routes": [{"prefix": "/api/", "upstream": "http://127.0.0.1:9000", "rate": 5, "cost": 3}]}`))
+	reload()
+	gw = gateway.Load().(*Gateway)
+	if r := gw.match("/api/x"); r == nil || r.Cost != 3 || r.Rate != 5 {
+		t.Fatal(r)
+	}
+
+	// a broken config leaves the gateway in effect
+	writeFile(t, configFile, []byte("gateway: "+routes+"\nkeypre: \"\"\n"))
+	writeFile(t, routes, []byte(`{"routes": [{"prefix": "/api/", "upstream": "http://127.0.0.1:9000", "cost": 4}]}`))
+	reload()
+	if gateway.Load().(*Gateway) != gw {
+		t.Fatal("invalid config applied")
+	}
+}
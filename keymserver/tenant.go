@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/shellow/keyman"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Tenants are the Keyman of each of Conf.Tenants by name, Keym serves the
+// requests none of them claims.
+var Tenants = make(map[string]*keyman.Keyman)
+
+// the gin context key of the Keyman serving a request
+const keymanContextKey = "keymserver.keyman"
+
+// useKeyman is the first middleware of the router of keym.
+func useKeyman(keym *keyman.Keyman) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(keymanContextKey, keym)
+	}
+}
+
+// keymanOf returns the Keyman of the tenant of c, keym outside a router
+// of useKeyman.
+func keymanOf(c *gin.Context, keym *keyman.Keyman) *keyman.Keyman {
+	if v, ok := c.Get(keymanContextKey); ok {
+		return v.(*keyman.Keyman)
+	}
+	return keym
+}
+
+// the name of the tenant of keym, "" for Keym
+func tenantName(keym *keyman.Keyman) string {
+	for name, k := range Tenants {
+		if k == keym {
+			return name
+		}
+	}
+	return ""
+}
+
+// keymans is Keym and the Keyman of every tenant, by name.
+func keymans() []*keyman.Keyman {
+	names := make([]string, 0, len(Tenants))
+	for name := range Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	all := []*keyman.Keyman{Keym}
+	for _, name := range names {
+		all = append(all, Tenants[name])
+	}
+	return all
+}
+
+// tenantRouter sends a request to the handler of the tenant named by its
+// header, or else of the tenant of its host, or else to fallback. A
+// header naming no tenant is refused.
+type tenantRouter struct {
+	header   string
+	byName   map[string]http.Handler
+	byHost   map[string]http.Handler
+	fallback http.Handler
+}
+
+func (tr *tenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if tr.header != "" {
+		if name := r.Header.Get(tr.header); name != "" {
+			h, ok := tr.byName[name]
+			if !ok {
+				http.Error(w, "tenant not exist", http.StatusNotFound)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if h, ok := tr.byHost[strings.ToLower(host)]; ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	tr.fallback.ServeHTTP(w, r)
+}
+
+// routeTenants returns the handler newHandler makes for each tenant,
+// routed by Conf.TenantHeader and host.
+func routeTenants(newHandler func(keym *keyman.Keyman) http.Handler) http.Handler {
+	if len(Conf.Tenants) == 0 {
+		return newHandler(Keym)
+	}
+	tr := &tenantRouter{
+		header:   Conf.TenantHeader,
+		byName:   make(map[string]http.Handler),
+		byHost:   make(map[string]http.Handler),
+		fallback: newHandler(Keym),
+	}
+	for _, t := range Conf.Tenants {
+		h := newHandler(Tenants[t.Name])
+		tr.byName[t.Name] = h
+		for _, host := range t.Hosts {
+			tr.byHost[strings.ToLower(host)] = h
+		}
+	}
+	return tr
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/shellow/keyman"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenantRouter(t *testing.T) {
+	Conf = defaultConfig()
+	Conf.TenantHeader = "X-Keymem-Tenant"
+	Conf.Tenants = []TenantConfig{
+		{Name: "acme", Hosts: []string{"api.acme.example"}},
+		{Name: "globex", Namespace: "gx"},
+	}
+	if err := Conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	Keym = &keyman.Keyman{}
+	Tenants = map[string]*keyman.Keyman{
+		"acme":   {Namespace: "acme"},
+		"globex": {Namespace: "gx"},
+	}
+	defer func() { Tenants = make(map[string]*keyman.Keyman) }()
+
+	h := routeTenants(func(keym *keyman.Keyman) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(keym.Namespace))
+		})
+	})
+	serve := func(host, tenant string) (int, string) {
+		req := httptest.NewRequest("GET", "/keymem/getownkey", nil)
+		req.Host = host
+		if tenant != "" {
+			req.Header.Set("X-Keymem-Tenant", tenant)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	if _, ns := serve("API.acme.example:8080", ""); ns != "acme" {
+		t.Error("by host:", ns)
+	}
+	if _, ns := serve("api.acme.example", "globex"); ns != "gx" {
+		t.Error("by header:", ns)
+	}
+	if _, ns := serve("localhost", ""); ns != "" {
+		t.Error("default:", ns)
+	}
+	if code, _ := serve("localhost", "initech"); code != http.StatusNotFound {
+		t.Error("unknown tenant:", code)
+	}
+
+	Conf.Tenants = append(Conf.Tenants, TenantConfig{Name: "hooli", Namespace: "acme"})
+	if err := Conf.Validate(); err == nil {
+		t.Fatal("shared namespace accepted")
+	}
+}
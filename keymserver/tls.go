@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// the reloader of the served certificate, nil without tls
+var certs *certReloader
+
+// certReloader serves the certificate in certFile and keyFile, read again
+// when either file has changed, checked at most once per interval. A pair
+// that fails to load leaves the one before in use.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, interval: interval}
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return last, err
+		}
+		if fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// Reload reads the certificate now.
+func (r *certReloader) Reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	due := time.Since(r.checked) >= r.interval
+	if due {
+		r.checked = time.Now()
+	}
+	cert, modTime := r.cert, r.modTime
+	r.mu.Unlock()
+
+	if due {
+		last, err := r.lastModified()
+		if err == nil && last.After(modTime) {
+			err = r.Reload()
+			if err != nil {
+				Logger.Error("reload certificate: ", err)
+			} else {
+				r.mu.Lock()
+				cert = r.cert
+				r.mu.Unlock()
+			}
+		}
+	}
+	return cert, nil
+}
+
+// newTLSConfig returns the server TLS config of conf, and the reloader of
+// its certificate.
+func newTLSConfig(conf TLSConfig) (*tls.Config, *certReloader, error) {
+	reloader, err := newCertReloader(conf.CertFile, conf.KeyFile, conf.ReloadInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if conf.ClientCAFile != "" {
+		b, err := ioutil.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, nil, errors.New("no certificate in " + conf.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if conf.ClientAuth == "require" {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsConfig, reloader, nil
+}
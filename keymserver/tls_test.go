@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/shellow/keyman"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var serial int64
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// a leaf certificate and key in PEM, for the server when client is false
+func (ca *testCA) issue(t *testing.T, name string, client bool) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"keymem"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if client {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		tmpl.IPAddresses = nil
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, b []byte) {
+	err := ioutil.WriteFile(path, b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	ca := newTestCA(t, "test ca")
+	cert1, key1 := ca.issue(t, "server one", false)
+	writeFile(t, certFile, cert1)
+	writeFile(t, keyFile, key1)
+	r, err := newCertReloader(certFile, keyFile, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := r.GetCertificate(nil)
+
+	cert2, key2 := ca.issue(t, "server two", false)
+	writeFile(t, certFile, cert2)
+	writeFile(t, keyFile, key2)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	second, _ := r.GetCertificate(nil)
+
+	if bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Fatal("certificate not reloaded")
+	}
+	block, _ := pem.Decode(cert2)
+	if !bytes.Equal(second.Certificate[0], block.Bytes) {
+		t.Fatal("not the new certificate")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serverCA := newTestCA(t, "server ca")
+	clientCA := newTestCA(t, "client ca")
+	serverCert, serverKey := serverCA.issue(t, "keymserver", false)
+	conf := TLSConfig{
+		CertFile:       filepath.Join(dir, "cert.pem"),
+		KeyFile:        filepath.Join(dir, "key.pem"),
+		ClientCAFile:   filepath.Join(dir, "clientca.pem"),
+		ClientAuth:     "require",
+		ReloadInterval: time.Minute,
+	}
+	writeFile(t, conf.CertFile, serverCert)
+	writeFile(t, conf.KeyFile, serverKey)
+	writeFile(t, conf.ClientCAFile, clientCA.pem)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cert := keyman.PeerCertificate(r.TLS)
+		if cert == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(keyman.CertFingerprint(cert) + " " + cert.Subject.String()))
+	}))
+	// StartTLS would add a certificate of its own
+	tlsConfig, _, err := newTLSConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Listener = tls.NewListener(srv.Listener, tlsConfig)
+	srv.Start()
+	defer srv.Close()
+	url := "https://" + srv.Listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverCA.pem)
+	client := func(certPEM, keyPEM []byte) *http.Client {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if certPEM != nil {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+
+	certPEM, keyPEM := clientCA.issue(t, "billing", true)
+	res, err := client(certPEM, keyPEM).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	block, _ := pem.Decode(certPEM)
+	cert, _ := x509.ParseCertificate(block.Bytes)
+	if string(body) != keyman.CertFingerprint(cert)+" CN=billing,O=keymem" {
+		t.Fatal(string(body))
+	}
+
+	_, err = client(nil, nil).Get(url)
+	if err == nil {
+		t.Fatal("connection without a client certificate accepted")
+	}
+	otherPEM, otherKey := serverCA.issue(t, "stranger", true)
+	_, err = client(otherPEM, otherKey).Get(url)
+	if err == nil {
+		t.Fatal("client certificate of another ca accepted")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"os"
+)
+
+const tracerName = "github.com/shellow/keyman"
+
+// newSpanExporter returns the exporter -trace names: "stdout", or "otlp"
+// set up by the OTEL_EXPORTER_OTLP_* environment variables.
+func newSpanExporter(name string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		return otlptracehttp.New(context.Background())
+	}
+	return nil, errors.New("unknown trace exporter " + name)
+}
+
+// initTracing traces Keym and the tenants with exp, continuing the traces of callers that
+// send W3C trace context. The returned shutdown flushes the spans left.
+func initTracing(exp sdktrace.SpanExporter) (shutdown func(context.Context) error) {
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("keymserver"))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	for _, keym := range keymans() {
+		keym.Tracer = tp.Tracer(tracerName)
+	}
+	return tp.Shutdown
+}
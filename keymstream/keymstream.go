@@ -0,0 +1,177 @@
+// Package keymstream reads the consumption stream a Keyman writes with
+// StartConsumeStream, to replay metered calls into other stores such as a
+// billing database. Consumer reads through a consumer group so several
+// processes share the work and nothing is lost on a restart; Replay reads a
+// range without one.
+package keymstream
+
+import (
+	"context"
+	"github.com/gomodule/redigo/redis"
+	"github.com/shellow/keyman"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCount = 100
+	defaultBlock = 5 * time.Second
+)
+
+// Handler stores a record. A record whose Handler fails is not
+// acknowledged and is read again by the next Run.
+type Handler func(rec *keyman.ConsumeRecord) error
+
+// Consumer is Name in the consumer group Group of Stream.
+type Consumer struct {
+	Pool   *redis.Pool
+	Stream string
+	Group  string
+	Name   string
+	// Count is the most records read at once, 100 when unset.
+	Count int
+	// Block is how long a read waits for new records, 5s when unset.
+	Block time.Duration
+}
+
+func (c *Consumer) count() int {
+	if c.Count <= 0 {
+		return defaultCount
+	}
+	return c.Count
+}
+
+func (c *Consumer) block() time.Duration {
+	if c.Block <= 0 {
+		return defaultBlock
+	}
+	return c.Block
+}
+
+// CreateGroup creates the group, and the stream if needed, reading from
+// start: "0" for the whole stream or "$" for new records only. A group
+// that exists is left as it is.
+func (c *Consumer) CreateGroup(start string) error {
+	redisConn := c.Pool.Get()
+	defer redisConn.Close()
+	_, err := redisConn.Do("XGROUP", "CREATE", c.Stream, c.Group, start, "MKSTREAM")
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// Run passes every record to h, those left pending by an earlier Run
+// first, and acknowledges it once h returns. It returns the error of h or
+// of Redis, or that of ctx once it is done.
+func (c *Consumer) Run(ctx context.Context, h Handler) error {
+	redisConn := c.Pool.Get()
+	defer redisConn.Close()
+
+	id := "0"
+	for ctx.Err() == nil {
+		reply, err := redis.DoWithTimeout(redisConn, c.block()+time.Second, "XREADGROUP",
+			"GROUP", c.Group, c.Name, "COUNT", c.count(), "BLOCK", int64(c.block()/time.Millisecond),
+			"STREAMS", c.Stream, id)
+		if err == redis.ErrNil || (err == nil && reply == nil) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		recs, trimmed, err := parseRead(reply)
+		if err != nil {
+			return err
+		}
+		if len(recs) == 0 && len(trimmed) == 0 && id == "0" {
+			// nothing pending, wait for new records
+			id = ">"
+			continue
+		}
+		for _, rec := range recs {
+			err = h(rec)
+			if err != nil {
+				return err
+			}
+			_, err = redisConn.Do("XACK", c.Stream, c.Group, rec.ID)
+			if err != nil {
+				return err
+			}
+		}
+		if len(trimmed) > 0 {
+			_, err = redisConn.Do("XACK", redis.Args{}.Add(c.Stream, c.Group).Add(trimmed...)...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// Replay passes the records of stream from id from to id to to h, in
+// order; "-" and "+" are the ends of the stream.
+func Replay(ctx context.Context, pool *redis.Pool, stream, from, to string, h Handler) error {
+	redisConn := pool.Get()
+	defer redisConn.Close()
+
+	for ctx.Err() == nil {
+		values, err := redis.Values(redisConn.Do("XRANGE", stream, from, to, "COUNT", defaultCount))
+		if err != nil {
+			return err
+		}
+		for _, v := range values {
+			rec, err := keyman.ParseConsumeRecord(v)
+			if err != nil {
+				return err
+			}
+			err = h(rec)
+			if err != nil {
+				return err
+			}
+			from = "(" + rec.ID
+		}
+		if len(values) < defaultCount {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+// the records in an XREADGROUP reply, and the ids of pending records the
+// stream was trimmed of
+func parseRead(reply interface{}) ([]*keyman.ConsumeRecord, []interface{}, error) {
+	streams, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var recs []*keyman.ConsumeRecord
+	var trimmed []interface{}
+	for _, s := range streams {
+		kv, err := redis.Values(s, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(kv) != 2 {
+			continue
+		}
+		entries, err := redis.Values(kv[1], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, e := range entries {
+			entry, err := redis.Values(e, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(entry) == 2 && entry[1] == nil {
+				trimmed = append(trimmed, entry[0])
+				continue
+			}
+			rec, err := keyman.ParseConsumeRecord(e)
+			if err != nil {
+				return nil, nil, err
+			}
+			recs = append(recs, rec)
+		}
+	}
+	return recs, trimmed, nil
+}
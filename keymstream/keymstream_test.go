@@ -0,0 +1,39 @@
+package keymstream
+
+import (
+	"testing"
+)
+
+func TestParseRead(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{
+			[]byte("consume"),
+			[]interface{}{
+				[]interface{}{
+					[]byte("1700000000000-0"),
+					[]interface{}{
+						[]byte("key_id"), []byte("0xabc"),
+						[]byte("route"), []byte("/api/"),
+						[]byte("units"), []byte("3"),
+						[]byte("time"), []byte("1700000000000"),
+						[]byte("token_id"), []byte(""),
+						[]byte("outcome"), []byte("pool"),
+					},
+				},
+				[]interface{}{[]byte("1700000000001-0"), nil},
+			},
+		},
+	}
+
+	recs, trimmed, err := parseRead(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || len(trimmed) != 1 {
+		t.Fatal(recs, trimmed)
+	}
+	rec := recs[0]
+	if rec.ID != "1700000000000-0" || rec.KeyID != "0xabc" || rec.Route != "/api/" || rec.Units != 3 || rec.Time != 1700000000000 || rec.Outcome != "pool" {
+		t.Fatal(rec)
+	}
+}
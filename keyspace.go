@@ -0,0 +1,107 @@
+package keyman
+
+import (
+	"context"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"strings"
+)
+
+const (
+	EventOrgExpired       = "org.expired"
+	EventCountersRemoved  = "counters.removed"
+	keyspaceNotifyEvents  = "Kgx"
+	keyspaceChannelPrefix = "__keyspace@"
+)
+
+// EnableKeyspaceEvents turns on the keyspace notifications ListenKeyspace
+// needs. Hosted Redis often refuses CONFIG, set notify-keyspace-events to
+// include "Kgx" there instead.
+func (keyman *Keyman) EnableKeyspaceEvents() error {
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	_, err := redisConn.Do("CONFIG", "SET", "notify-keyspace-events", keyspaceNotifyEvents)
+	return err
+}
+
+// ListenKeyspace emits an event when a counter under Keypre in database db
+// expires or is deleted, until ctx is done: key.expired or org.expired for
+// expiry, counters.removed for a delete.
+func (keyman *Keyman) ListenKeyspace(ctx context.Context, db int) error {
+	prefix := keyspaceChannelPrefix + strconv.Itoa(db) + "__:"
+	psc := redis.PubSubConn{Conn: keyman.RedisPool.Get()}
+	defer psc.Close()
+	err := psc.PSubscribe(prefix + keyman.rkey(keyman.Keypre) + "*")
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			psc.PUnsubscribe()
+		case <-stop:
+		}
+	}()
+
+	for {
+		// pubsub waits for messages, the read timeout of the pool does not
+		// apply
+		switch v := psc.ReceiveWithTimeout(0).(type) {
+		case redis.Message:
+			err = keyman.keyspaceEvent(strings.TrimPrefix(v.Channel, prefix+keyman.rkey("")), string(v.Data))
+			if err != nil {
+				return err
+			}
+		case redis.Subscription:
+			if v.Count == 0 {
+				return ctx.Err()
+			}
+		case error:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return v
+		}
+	}
+}
+
+func (keyman *Keyman) keyspaceEvent(name, op string) error {
+	if op != "expired" && op != "del" {
+		return nil
+	}
+	name = keyman.keyDelPre(name)
+
+	var ev Event
+	switch {
+	case strings.HasPrefix(name, genOrgKey("")):
+		ev.Target = strings.TrimPrefix(name, genOrgKey(""))
+		ev.Type = EventCountersRemoved
+		if op == "expired" {
+			ev.Type = EventOrgExpired
+		}
+	case strings.HasPrefix(name, genPoolKey("")):
+		ev.Target = strings.TrimPrefix(name, genPoolKey(""))
+		ev.Type = EventCountersRemoved
+	default:
+		redisConn := keyman.redisConn()
+		defer redisConn.Close()
+		isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("keys"), keyman.keyAddPre(name)))
+		if err != nil {
+			return err
+		}
+		if isExist == 0 {
+			return nil
+		}
+		if op == "expired" {
+			// CheckExpiry reports the same expiry, once between both
+			return keyman.emitOnce(redisConn, genExpiryKey(EventKeyExpired, name), 0, Event{Type: EventKeyExpired, Key: name})
+		}
+		ev.Type = EventCountersRemoved
+		ev.Key = name
+	}
+	keyman.emit(ev)
+	return nil
+}
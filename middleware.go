@@ -0,0 +1,111 @@
+package keyman
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+const identityKey = "keymem.identity"
+
+func setIdentity(c *gin.Context, id *Identity) {
+	c.Set(identityKey, id)
+}
+
+// GetIdentity returns the identity stored by a Require middleware, or by
+// a net/http middleware in the request context.
+func GetIdentity(c *gin.Context) (*Identity, bool) {
+	v, ok := c.Get(identityKey)
+	if !ok {
+		if c.Request == nil {
+			return nil, false
+		}
+		return FromContext(c.Request.Context())
+	}
+	id, ok := v.(*Identity)
+	return id, ok
+}
+
+func GetKeyQuota(c *gin.Context) (*Quota, bool) {
+	id, ok := GetIdentity(c)
+	if !ok || id.Quota == nil {
+		return nil, false
+	}
+	return id.Quota, true
+}
+
+func GetTokenInfo(c *gin.Context) (*TokenInfo, bool) {
+	id, ok := GetIdentity(c)
+	if !ok || id.Token == nil {
+		return nil, false
+	}
+	return id.Token, true
+}
+
+func (keyman *Keyman) checkQuotaOnlytime(q *Quota) error {
+	if !q.Exist {
+		return ErrAccessDenied
+	}
+	if !q.Enabled {
+		return ErrKeyExpired
+	}
+	return nil
+}
+
+func (keyman *Keyman) ginMiddleware(cred func(c *gin.Context) Credentials, opts ...RequireOption) gin.HandlerFunc {
+	o := new(requireOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return func(c *gin.Context) {
+		d, err := keyman.Authorize(c.Request.Context(), cred(c), c.Request.URL.Path, opts...)
+		if err != nil {
+			keyman.AbortError(c, err)
+			return
+		}
+		if !d.Allow {
+			keyman.AbortError(c, d.Err)
+			return
+		}
+
+		if o.headers && d.Identity.Quota != nil {
+			d.Identity.Quota.SetHeaders(c.Writer.Header())
+		}
+		setIdentity(c, d.Identity)
+		c.Request = c.Request.WithContext(NewContext(c.Request.Context(), d.Identity))
+		c.Next()
+	}
+}
+
+// RequireKey is middleware that aborts unless the key header, or else the
+// verified client certificate, holds a valid key, and stores its Identity
+// for the handlers after it.
+func (keyman *Keyman) RequireKey(opts ...RequireOption) gin.HandlerFunc {
+	return keyman.ginMiddleware(func(c *gin.Context) Credentials {
+		return Credentials{Key: c.GetHeader("key"), Cert: PeerCertificate(c.Request.TLS)}
+	}, opts...)
+}
+
+// RequirePathQuota is RequireKey with a path quota on the request path.
+func (keyman *Keyman) RequirePathQuota(opts ...RequireOption) gin.HandlerFunc {
+	return keyman.RequireKey(append(opts, WithPathQuota())...)
+}
+
+// RequireToken is middleware that aborts unless the token header, or the
+// token query parameter, holds a live token for the request route.
+func (keyman *Keyman) RequireToken() gin.HandlerFunc {
+	return keyman.ginMiddleware(func(c *gin.Context) Credentials {
+		token := c.GetHeader("token")
+		if token == "" {
+			token = c.Query("token")
+		}
+		return Credentials{Token: token}
+	})
+}
+
+// RequireManager is middleware that aborts unless the key header holds a
+// management key.
+func (keyman *Keyman) RequireManager() gin.HandlerFunc {
+	return keyman.ginMiddleware(func(c *gin.Context) Credentials {
+		return Credentials{Key: c.GetHeader("key"), Manager: true}
+	})
+}
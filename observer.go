@@ -0,0 +1,44 @@
+package keyman
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// Observer is told about the work Keyman does, to keep metrics. Methods
+// run on the goroutine doing the work and must not block.
+type Observer interface {
+	// Decision is called for every Authorize, err is the failure of the
+	// store if any.
+	Decision(d Decision, err error)
+	TokenIssued()
+	// TokenChecked reports whether a token was found in the cache.
+	TokenChecked(hit bool)
+	// Consumed is called after n units were debited, route is the path of
+	// the path quota or empty.
+	Consumed(route string, n int64)
+	RedisCommand(command string, d time.Duration, err error)
+}
+
+type observedConn struct {
+	redis.Conn
+	observer Observer
+}
+
+func (c observedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := c.Conn.Do(commandName, args...)
+	if commandName != "" {
+		c.observer.RedisCommand(commandName, time.Since(start), err)
+	}
+	return reply, err
+}
+
+// a connection from the pool, timed when there is an Observer
+func (keyman *Keyman) redisConn() redis.Conn {
+	redisConn := keyman.RedisPool.Get()
+	if keyman.Observer == nil {
+		return redisConn
+	}
+	return observedConn{redisConn, keyman.Observer}
+}
@@ -0,0 +1,444 @@
+package keyman
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type HOrg struct {
+	Org  string `form:"org" json:"org" xml:"org" binding:"required"`
+	Name string `form:"name" json:"name" xml:"name"`
+}
+
+type Org struct {
+	Org    string `form:"org" json:"org" xml:"org" binding:"required"`
+	Expday int    `form:"expday" json:"expday" xml:"expday"`
+	Number int64  `form:"number" json:"number" xml:"number"`
+}
+
+func genOrgKey(org string) string {
+	return "org-" + org
+}
+
+func (keyman *Keyman) GetKeyOrg(key string) (string, error) {
+	return keyman.getKeyOrg(context.Background(), key)
+}
+
+func (keyman *Keyman) getKeyOrg(ctx context.Context, key string) (string, error) {
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+	org, err := redis.String(redisConn.Do("HGET", keyman.rkey("keyorgs"), keyman.keyAddPre(key)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return org, err
+}
+
+func (keyman *Keyman) CheckOrg(org string) error {
+	return keyman.checkOrg(context.Background(), org)
+}
+
+func (keyman *Keyman) checkOrg(ctx context.Context, org string) error {
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+	num, err := redis.Int(redisConn.Do("GET", keyman.rkey(keyman.keyAddPre(genOrgKey(org)))))
+	if err == redis.ErrNil {
+		return ErrOrgExpired
+	} else if err != nil {
+		return err
+	}
+	if num <= 0 {
+		return ErrOrgQuotaExhausted
+	}
+	return nil
+}
+
+// an org without a counter for reqpath has no path limit of its own
+func (keyman *Keyman) CheckOrgPathCount(reqpath, org string) error {
+	return keyman.checkOrgPathCount(context.Background(), reqpath, org)
+}
+
+func (keyman *Keyman) checkOrgPathCount(ctx context.Context, reqpath, org string) error {
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+	number, err := redis.Int(redisConn.Do("GET", keyman.rkey(genCountKey(reqpath, genOrgKey(org)))))
+	if err == redis.ErrNil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if number <= 0 {
+		return ErrOrgQuotaExhausted
+	}
+	return nil
+}
+
+func (keyman *Keyman) Addorg(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	var org HOrg
+	err = c.BindJSON(&org)
+	if err != nil {
+		keyman.renderError(c, badRequest(err.Error()))
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HSET", keyman.rkey("orgs"), keyman.keyAddPre(org.Org), org.Name)
+	err = keyman.execAudited(redisConn, c, priv, "addorg", org.Org, nil, gin.H{"name": org.Name})
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"org":    org.Org,
+		"name":   org.Name,
+	})
+}
+
+func (keyman *Keyman) Delorg(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	var org HOrg
+	err = c.BindJSON(&org)
+	if err != nil {
+		keyman.renderError(c, badRequest(err.Error()))
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+
+	keys, err := keyman.orgKeys(redisConn, org.Org)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if len(keys) > 0 {
+		keyman.renderError(c, conflict("org has keys"))
+		return
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HDEL", keyman.rkey("orgs"), keyman.keyAddPre(org.Org))
+	redisConn.Send("DEL", keyman.rkey(keyman.keyAddPre(genOrgKey(org.Org))))
+	err = keyman.execAudited(redisConn, c, priv, "delorg", org.Org, nil, nil)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"org":    org.Org,
+	})
+}
+
+func (keyman *Keyman) EnableOrg(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	var org Org
+	err = c.BindJSON(&org)
+	if err != nil {
+		keyman.renderError(c, badRequest(err.Error()))
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("orgs"), keyman.keyAddPre(org.Org)))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if isExist == 0 {
+		keyman.renderError(c, ErrOrgNotFound)
+		return
+	}
+
+	exptime := time.Now()
+	exptime = exptime.Add(time.Duration(org.Expday) * time.Hour * 24)
+	sec := exptime.Unix()
+	redisConn.Send("MULTI")
+	redisConn.Send("SET", keyman.rkey(keyman.keyAddPre(genOrgKey(org.Org))), org.Number)
+	redisConn.Send("EXPIREAT", keyman.rkey(keyman.keyAddPre(genOrgKey(org.Org))), sec)
+	err = keyman.execAudited(redisConn, c, priv, "enableorg", org.Org, nil, gin.H{"number": org.Number, "expday": org.Expday})
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "ok",
+		"expdate": exptime.Format("2006-01-02T15:04:05"),
+		"number":  org.Number,
+	})
+}
+
+func (keyman *Keyman) orgKeys(redisConn redis.Conn, org string) ([]string, error) {
+	keyorgs, err := redis.StringMap(redisConn.Do("HGETALL", keyman.rkey("keyorgs")))
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for k, o := range keyorgs {
+		if o == org && strings.HasPrefix(k, keyman.Keypre) {
+			keys = append(keys, keyman.keyDelPre(k))
+		}
+	}
+	return keys, nil
+}
+
+func (keyman *Keyman) Getorg(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	var org HOrg
+	err = c.BindJSON(&org)
+	if err != nil {
+		keyman.renderError(c, badRequest(err.Error()))
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+
+	name, err := redis.String(redisConn.Do("HGET", keyman.rkey("orgs"), keyman.keyAddPre(org.Org)))
+	if err == redis.ErrNil {
+		keyman.renderError(c, ErrOrgNotFound)
+		return
+	} else if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	sec, err := redis.Int(redisConn.Do("TTL", keyman.rkey(keyman.keyAddPre(genOrgKey(org.Org)))))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if sec < 0 {
+		sec = 0
+	}
+
+	number, err := redis.Int(redisConn.Do("GET", keyman.rkey(keyman.keyAddPre(genOrgKey(org.Org)))))
+	if err == redis.ErrNil {
+		number = 0
+	} else if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	keys, err := keyman.orgKeys(redisConn, org.Org)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	expdate := time.Now().Add(time.Duration(sec) * time.Second)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "ok",
+		"name":    name,
+		"sec":     sec,
+		"expdate": expdate,
+		"number":  number,
+		"keys":    keys,
+	})
+}
+
+func (keyman *Keyman) Listorg(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+
+	orgs, err := redis.Strings(redisConn.Do("HKEYS", keyman.rkey("orgs")))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	var retorgs []string
+	for i := 0; i < len(orgs); i++ {
+		if strings.HasPrefix(orgs[i], keyman.Keypre) {
+			retorgs = append(retorgs, keyman.keyDelPre(orgs[i]))
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"orgs":   retorgs,
+	})
+}
+
+// SetKeyOrg moves a key into org, an empty org detaches the key.
+func (keyman *Keyman) SetKeyOrg(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	key := c.Request.FormValue("key")
+	if strings.EqualFold("", key) {
+		keyman.renderError(c, badRequest("require key"))
+		return
+	}
+	org := c.Request.FormValue("org")
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("keys"), keyman.keyAddPre(key)))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if isExist == 0 {
+		keyman.renderError(c, ErrKeyNotFound)
+		return
+	}
+
+	if org != "" {
+		isExist, err = redis.Int(redisConn.Do("HEXISTS", keyman.rkey("orgs"), keyman.keyAddPre(org)))
+		if err != nil {
+			keyman.renderError(c, err)
+			return
+		}
+		if isExist == 0 {
+			keyman.renderError(c, ErrOrgNotFound)
+			return
+		}
+	}
+
+	redisConn.Send("MULTI")
+	if org == "" {
+		redisConn.Send("HDEL", keyman.rkey("keyorgs"), keyman.keyAddPre(key))
+	} else {
+		redisConn.Send("HSET", keyman.rkey("keyorgs"), keyman.keyAddPre(key), org)
+	}
+	err = keyman.execAudited(redisConn, c, priv, "setkeyorg", KeyToAddrStr(key), nil, gin.H{"org": org})
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"key":    key,
+		"org":    org,
+	})
+}
+
+func (keyman *Keyman) AddOrgCount(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	org := c.Request.FormValue("org")
+	if strings.EqualFold("", org) {
+		keyman.renderError(c, badRequest("require org"))
+		return
+	}
+
+	reqpath := c.Request.FormValue("reqpath")
+	if strings.EqualFold("", reqpath) {
+		keyman.renderError(c, badRequest("require reqpath"))
+		return
+	}
+
+	count := c.Request.FormValue("count")
+	if strings.EqualFold("", count) {
+		keyman.renderError(c, badRequest("require count"))
+		return
+	}
+
+	countInt, err := strconv.Atoi(count)
+	if err != nil {
+		keyman.renderError(c, badRequest("count error"))
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("orgs"), keyman.keyAddPre(org)))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if isExist == 0 {
+		keyman.renderError(c, ErrOrgNotFound)
+		return
+	}
+
+	_, err = keyman.auditIncr(redisConn, c, priv, "addorgcount", org, int64(countInt),
+		[]string{keyman.rkey(genCountKey(reqpath, genOrgKey(org)))}, []string{"number"},
+		gin.H{"reqpath": reqpath}, gin.H{"reqpath": reqpath})
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
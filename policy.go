@@ -0,0 +1,239 @@
+package keyman
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Policy relaxes the hard cutoff of a key. Soft is the remaining number at
+// which a low balance is reported, Overdraft the units a key may use past
+// zero, counted separately so they can be billed. The zero Policy is the
+// default hard cutoff.
+type Policy struct {
+	Soft      int64 `json:"soft"`
+	Overdraft int64 `json:"overdraft"`
+}
+
+func genOverdraftKey(key string) string {
+	return "overdraft-" + key
+}
+
+// the times ResetOverdraft reads the overdraft again when it changed
+// before the reset
+const maxResetAttempts = 3
+
+func (keyman *Keyman) GetPolicy(key string) (*Policy, error) {
+	return keyman.getPolicy(context.Background(), key)
+}
+
+func (keyman *Keyman) getPolicy(ctx context.Context, key string) (*Policy, error) {
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+	policy := new(Policy)
+	b, err := redis.Bytes(redisConn.Do("HGET", keyman.rkey("policies"), keyman.keyAddPre(key)))
+	if err == redis.ErrNil {
+		return policy, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, policy)
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (keyman *Keyman) CheckOverdraft(key string) error {
+	return keyman.checkOverdraft(context.Background(), key)
+}
+
+func (keyman *Keyman) checkOverdraft(ctx context.Context, key string) error {
+	policy, err := keyman.getPolicy(ctx, key)
+	if err != nil {
+		return err
+	}
+	if policy.Overdraft <= 0 {
+		return ErrQuotaExhausted
+	}
+
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+	used, err := redis.Int64(redisConn.Do("GET", keyman.rkey(genOverdraftKey(key))))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if used >= policy.Overdraft {
+		return ErrQuotaExhausted
+	}
+	return nil
+}
+
+// report the balance when a debit of n reached zero or crossed the soft
+// limit, a refused debit is reported by consume
+func (keyman *Keyman) checkBalance(policy *Policy, key, reqpath string, remaining, n int64) {
+	if remaining == 0 {
+		keyman.emit(Event{Type: EventQuotaExhausted, Key: key, Route: reqpath, Value: remaining})
+	} else if remaining <= policy.Soft && remaining+n > policy.Soft {
+		keyman.emit(Event{Type: EventLowBalance, Key: key, Route: reqpath, Value: remaining})
+	}
+}
+
+func (keyman *Keyman) SetPolicy(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	key := c.Request.FormValue("key")
+	if strings.EqualFold("", key) {
+		keyman.renderError(c, badRequest("require key"))
+		return
+	}
+
+	var policy Policy
+	policy.Soft, err = strconv.ParseInt(c.DefaultPostForm("soft", "0"), 10, 64)
+	if err != nil || policy.Soft < 0 {
+		keyman.renderError(c, badRequest("soft error"))
+		return
+	}
+	policy.Overdraft, err = strconv.ParseInt(c.DefaultPostForm("overdraft", "0"), 10, 64)
+	if err != nil || policy.Overdraft < 0 {
+		keyman.renderError(c, badRequest("overdraft error"))
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("keys"), keyman.keyAddPre(key)))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if isExist == 0 {
+		keyman.renderError(c, ErrKeyNotFound)
+		return
+	}
+
+	b, err := json.Marshal(policy)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	redisConn.Send("MULTI")
+	redisConn.Send("HSET", keyman.rkey("policies"), keyman.keyAddPre(key), b)
+	err = keyman.execAudited(redisConn, c, priv, "setpolicy", KeyToAddrStr(key), nil, policy)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "ok",
+		"key":       key,
+		"soft":      policy.Soft,
+		"overdraft": policy.Overdraft,
+	})
+}
+
+func (keyman *Keyman) Getpolicy(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	key := c.Request.FormValue("key")
+	if strings.EqualFold("", key) {
+		keyman.renderError(c, badRequest("require key"))
+		return
+	}
+
+	policy, err := keyman.GetPolicy(key)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	used, err := redis.Int64(redisConn.Do("GET", keyman.rkey(genOverdraftKey(key))))
+	if err != nil && err != redis.ErrNil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":        "ok",
+		"soft":          policy.Soft,
+		"overdraft":     policy.Overdraft,
+		"overdraftused": used,
+	})
+}
+
+// ResetOverdraft returns the overdraft used so far and starts counting
+// from zero again, meant to be called when the usage has been billed.
+func (keyman *Keyman) ResetOverdraft(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	key := c.Request.FormValue("key")
+	if strings.EqualFold("", key) {
+		keyman.renderError(c, badRequest("require key"))
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	// the reset is retried when the overdraft is drawn on between the
+	// read and the write
+	var used int64
+	for attempt := 0; attempt < maxResetAttempts; attempt++ {
+		redisConn.Send("WATCH", keyman.rkey(genOverdraftKey(key)))
+		used, err = redis.Int64(redisConn.Do("GET", keyman.rkey(genOverdraftKey(key))))
+		if err != nil && err != redis.ErrNil {
+			redisConn.Do("UNWATCH")
+			keyman.renderError(c, err)
+			return
+		}
+		redisConn.Send("MULTI")
+		redisConn.Send("SET", keyman.rkey(genOverdraftKey(key)), 0)
+		err = keyman.execAudited(redisConn, c, priv, "resetoverdraft", KeyToAddrStr(key),
+			gin.H{"overdraftused": used}, gin.H{"overdraftused": 0})
+		if err != redis.ErrNil {
+			break
+		}
+	}
+	if err == redis.ErrNil {
+		keyman.renderError(c, conflict("overdraft in use"))
+		return
+	} else if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":        "ok",
+		"overdraftused": used,
+	})
+}
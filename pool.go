@@ -0,0 +1,582 @@
+package keyman
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type HPool struct {
+	Pool string `form:"pool" json:"pool" xml:"pool" binding:"required"`
+	Name string `form:"name" json:"name" xml:"name"`
+}
+
+type Transfer struct {
+	ID         string `json:"id"`
+	Time       int64  `json:"time"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Reqpath    string `json:"reqpath"`
+	Operator   string `json:"operator"`
+	Count      int64  `json:"count"`
+	FromBefore int64  `json:"from_before"`
+	ToBefore   int64  `json:"to_before"`
+	FromAfter  int64  `json:"from_after"`
+	ToAfter    int64  `json:"to_after"`
+}
+
+// move ARGV[1] units from KEYS[1] to KEYS[2] and log the transfer to
+// KEYS[3], trimmed to ARGV[9] entries, in the same step, so the sum of
+// both counters never changes; the audit stream KEYS[4], of MAXLEN
+// ARGV[10] when it is not 0, gets the entry of request ARGV[11] from ip
+// ARGV[12]
+var transferScript = redis.NewScript(4, `
+local count = tonumber(ARGV[1])
+local fv = redis.call('GET', KEYS[1])
+if fv == false then
+	return redis.error_reply('source counter not exist')
+end
+if tonumber(fv) < count then
+	return redis.error_reply('not enough quota')
+end
+local tv = redis.call('GET', KEYS[2])
+if tv == false and ARGV[2] == '1' then
+	return redis.error_reply('target counter not exist')
+end
+tv = tonumber(tv or '0')
+local fa = redis.call('DECRBY', KEYS[1], count)
+local ta = redis.call('INCRBY', KEYS[2], count)
+redis.call('LPUSH', KEYS[3], cjson.encode({
+	id = ARGV[3],
+	time = tonumber(ARGV[4]),
+	from = ARGV[5],
+	to = ARGV[6],
+	reqpath = ARGV[7],
+	operator = ARGV[8],
+	count = count,
+	from_before = tonumber(fv),
+	to_before = tv,
+	from_after = fa,
+	to_after = ta
+}))
+redis.call('LTRIM', KEYS[3], 0, tonumber(ARGV[9]) - 1)
+local args = {KEYS[4]}
+if tonumber(ARGV[10]) > 0 then
+	table.insert(args, 'MAXLEN')
+	table.insert(args, '~')
+	table.insert(args, ARGV[10])
+end
+for _, v in ipairs({'*', 'time', ARGV[4], 'operator', ARGV[8], 'action', 'transfer', 'target', ARGV[5],
+	'before', cjson.encode({reqpath = ARGV[7], number = tonumber(fv)}),
+	'after', cjson.encode({reqpath = ARGV[7], number = fa, to = ARGV[6], count = count}),
+	'request_id', ARGV[11], 'ip', ARGV[12]}) do
+	table.insert(args, v)
+end
+redis.call('XADD', unpack(args))
+return {fa, ta}
+`)
+
+const defaultTransferMaxLen = 10000
+
+func (keyman *Keyman) transferMaxLen() int64 {
+	if keyman.TransferMaxLen <= 0 {
+		return defaultTransferMaxLen
+	}
+	return keyman.TransferMaxLen
+}
+
+func genPoolKey(pool string) string {
+	return "pool-" + pool
+}
+
+// manager identity safe to record, the address of the management key
+func manID(priv *ecdsa.PrivateKey) string {
+	addr := crypto.PubkeyToAddress(priv.PublicKey)
+	return AddrToStr(&addr)
+}
+
+func (keyman *Keyman) GetKeyPool(key string) (string, error) {
+	return keyman.getKeyPool(context.Background(), key)
+}
+
+func (keyman *Keyman) getKeyPool(ctx context.Context, key string) (string, error) {
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+	pool, err := redis.String(redisConn.Do("HGET", keyman.rkey("keypools"), keyman.keyAddPre(key)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return pool, err
+}
+
+// CheckKeyPool reports whether a key whose own counter is used up can
+// still draw from its pool.
+func (keyman *Keyman) CheckKeyPool(key string) error {
+	return keyman.checkKeyPool(context.Background(), key)
+}
+
+func (keyman *Keyman) checkKeyPool(ctx context.Context, key string) error {
+	pool, err := keyman.getKeyPool(ctx, key)
+	if err != nil {
+		return err
+	}
+	if pool == "" {
+		return ErrQuotaExhausted
+	}
+
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+	num, err := redis.Int(redisConn.Do("GET", keyman.rkey(keyman.keyAddPre(genPoolKey(pool)))))
+	if err == redis.ErrNil {
+		return ErrQuotaExhausted
+	} else if err != nil {
+		return err
+	}
+	if num <= 0 {
+		return ErrQuotaExhausted
+	}
+	return nil
+}
+
+func (keyman *Keyman) Addpool(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	var pool HPool
+	err = c.BindJSON(&pool)
+	if err != nil {
+		keyman.renderError(c, badRequest(err.Error()))
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HSET", keyman.rkey("pools"), keyman.keyAddPre(pool.Pool), pool.Name)
+	err = keyman.execAudited(redisConn, c, priv, "addpool", pool.Pool, nil, gin.H{"name": pool.Name})
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"pool":   pool.Pool,
+		"name":   pool.Name,
+	})
+}
+
+func (keyman *Keyman) poolKeys(redisConn redis.Conn, pool string) ([]string, error) {
+	keypools, err := redis.StringMap(redisConn.Do("HGETALL", keyman.rkey("keypools")))
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for k, p := range keypools {
+		if p == pool && strings.HasPrefix(k, keyman.Keypre) {
+			keys = append(keys, keyman.keyDelPre(k))
+		}
+	}
+	return keys, nil
+}
+
+func (keyman *Keyman) Delpool(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	var pool HPool
+	err = c.BindJSON(&pool)
+	if err != nil {
+		keyman.renderError(c, badRequest(err.Error()))
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+
+	keys, err := keyman.poolKeys(redisConn, pool.Pool)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if len(keys) > 0 {
+		keyman.renderError(c, conflict("pool has keys"))
+		return
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HDEL", keyman.rkey("pools"), keyman.keyAddPre(pool.Pool))
+	redisConn.Send("DEL", keyman.rkey(keyman.keyAddPre(genPoolKey(pool.Pool))))
+	err = keyman.execAudited(redisConn, c, priv, "delpool", pool.Pool, nil, nil)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"pool":   pool.Pool,
+	})
+}
+
+func (keyman *Keyman) AddPoolCount(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	pool := c.Request.FormValue("pool")
+	if strings.EqualFold("", pool) {
+		keyman.renderError(c, badRequest("require pool"))
+		return
+	}
+
+	count := c.Request.FormValue("count")
+	if strings.EqualFold("", count) {
+		keyman.renderError(c, badRequest("require count"))
+		return
+	}
+
+	countInt, err := strconv.Atoi(count)
+	if err != nil {
+		keyman.renderError(c, badRequest("count error"))
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("pools"), keyman.keyAddPre(pool)))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if isExist == 0 {
+		keyman.renderError(c, ErrPoolNotFound)
+		return
+	}
+
+	after, err := keyman.auditIncr(redisConn, c, priv, "addpoolcount", pool, int64(countInt),
+		[]string{keyman.rkey(keyman.keyAddPre(genPoolKey(pool)))}, []string{"number"},
+		gin.H{}, gin.H{})
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	number := after[0]
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"number": number,
+	})
+}
+
+func (keyman *Keyman) Getpool(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	var pool HPool
+	err = c.BindJSON(&pool)
+	if err != nil {
+		keyman.renderError(c, badRequest(err.Error()))
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+
+	name, err := redis.String(redisConn.Do("HGET", keyman.rkey("pools"), keyman.keyAddPre(pool.Pool)))
+	if err == redis.ErrNil {
+		keyman.renderError(c, ErrPoolNotFound)
+		return
+	} else if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	number, err := redis.Int(redisConn.Do("GET", keyman.rkey(keyman.keyAddPre(genPoolKey(pool.Pool)))))
+	if err == redis.ErrNil {
+		number = 0
+	} else if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	keys, err := keyman.poolKeys(redisConn, pool.Pool)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"name":   name,
+		"number": number,
+		"keys":   keys,
+	})
+}
+
+func (keyman *Keyman) Listpool(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+
+	pools, err := redis.Strings(redisConn.Do("HKEYS", keyman.rkey("pools")))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	var retpools []string
+	for i := 0; i < len(pools); i++ {
+		if strings.HasPrefix(pools[i], keyman.Keypre) {
+			retpools = append(retpools, keyman.keyDelPre(pools[i]))
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"pools":  retpools,
+	})
+}
+
+// SetKeyPool lets a key draw from pool, an empty pool detaches the key.
+func (keyman *Keyman) SetKeyPool(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	key := c.Request.FormValue("key")
+	if strings.EqualFold("", key) {
+		keyman.renderError(c, badRequest("require key"))
+		return
+	}
+	pool := c.Request.FormValue("pool")
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("keys"), keyman.keyAddPre(key)))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if isExist == 0 {
+		keyman.renderError(c, ErrKeyNotFound)
+		return
+	}
+
+	if pool != "" {
+		isExist, err = redis.Int(redisConn.Do("HEXISTS", keyman.rkey("pools"), keyman.keyAddPre(pool)))
+		if err != nil {
+			keyman.renderError(c, err)
+			return
+		}
+		if isExist == 0 {
+			keyman.renderError(c, ErrPoolNotFound)
+			return
+		}
+	}
+
+	redisConn.Send("MULTI")
+	if pool == "" {
+		redisConn.Send("HDEL", keyman.rkey("keypools"), keyman.keyAddPre(key))
+	} else {
+		redisConn.Send("HSET", keyman.rkey("keypools"), keyman.keyAddPre(key), pool)
+	}
+	err = keyman.execAudited(redisConn, c, priv, "setkeypool", KeyToAddrStr(key), nil, gin.H{"pool": pool})
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"key":    key,
+		"pool":   pool,
+	})
+}
+
+// Transfer moves count units from one key's counter to another's, or
+// between their counters for reqpath when it is given.
+func (keyman *Keyman) Transfer(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	from := c.Request.FormValue("from")
+	if strings.EqualFold("", from) {
+		keyman.renderError(c, badRequest("require from"))
+		return
+	}
+
+	to := c.Request.FormValue("to")
+	if strings.EqualFold("", to) {
+		keyman.renderError(c, badRequest("require to"))
+		return
+	}
+
+	count := c.Request.FormValue("count")
+	if strings.EqualFold("", count) {
+		keyman.renderError(c, badRequest("require count"))
+		return
+	}
+
+	countInt, err := strconv.Atoi(count)
+	if err != nil || countInt <= 0 {
+		keyman.renderError(c, badRequest("count error"))
+		return
+	}
+
+	reqpath := c.Request.FormValue("reqpath")
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	for _, key := range []string{from, to} {
+		isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("keys"), keyman.keyAddPre(key)))
+		if err != nil {
+			keyman.renderError(c, err)
+			return
+		}
+		if isExist == 0 {
+			keyman.renderError(c, ErrKeyNotFound)
+			return
+		}
+	}
+
+	// key counters carry the expiry, so the target must be enabled;
+	// a path counter is created on first transfer like in AddCount
+	fromKey, toKey, toRequired := keyman.rkey(keyman.keyAddPre(from)), keyman.rkey(keyman.keyAddPre(to)), "1"
+	if reqpath != "" {
+		fromKey, toKey, toRequired = keyman.rkey(genCountKey(reqpath, from)), keyman.rkey(genCountKey(reqpath, to)), "0"
+	}
+
+	now := time.Now()
+	after, err := redis.Int64s(transferScript.Do(redisConn,
+		fromKey, toKey, keyman.rkey("transfers"), keyman.rkey("audit"),
+		countInt, toRequired, genLeaseID(), now.Unix(),
+		KeyToAddrStr(from), KeyToAddrStr(to), reqpath, manID(priv), keyman.transferMaxLen(),
+		keyman.AuditMaxLen, requestID(c), c.ClientIP()))
+	if rerr, ok := err.(redis.Error); ok {
+		switch rerr.Error() {
+		case "source counter not exist", "not enough quota", "target counter not exist":
+			keyman.renderError(c, conflict(rerr.Error()))
+		default:
+			// the script did not run to its end, e.g. on a WRONGTYPE
+			keyman.renderError(c, &Error{"INTERNAL_ERROR", http.StatusInternalServerError, rerr.Error()})
+		}
+		return
+	} else if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"from":   after[0],
+		"to":     after[1],
+	})
+}
+
+func (keyman *Keyman) ListTransfer(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	start, err := strconv.Atoi(c.DefaultQuery("start", "0"))
+	if err != nil || start < 0 {
+		keyman.renderError(c, badRequest("start error"))
+		return
+	}
+	num, err := strconv.Atoi(c.DefaultQuery("num", "100"))
+	if err != nil || num <= 0 {
+		keyman.renderError(c, badRequest("num error"))
+		return
+	}
+	if num > maxListCount {
+		num = maxListCount
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+
+	recs, err := redis.ByteSlices(redisConn.Do("LRANGE", keyman.rkey("transfers"), start, start+num-1))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	transfers := make([]Transfer, 0, len(recs))
+	for _, rec := range recs {
+		var t Transfer
+		err = json.Unmarshal(rec, &t)
+		if err != nil {
+			continue
+		}
+		transfers = append(transfers, t)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "ok",
+		"transfers": transfers,
+	})
+}
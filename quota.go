@@ -0,0 +1,205 @@
+package keyman
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Quota is what a single store round trip knows about a key, and a path
+// when one was asked for. Limits are 0 when they were never recorded.
+type Quota struct {
+	Key       string
+	Name      string
+	Exist     bool
+	Enabled   bool
+	Number    int64
+	Limit     int64
+	Sec       int64
+	Expdate   time.Time
+	Reqpath   string
+	PathCount int64
+	PathTotal int64
+	Org       string
+	Pool      string
+	Policy    Policy
+	Overdraft int64
+}
+
+func (keyman *Keyman) GetQuota(reqpath, key string) (*Quota, error) {
+	return keyman.getQuota(context.Background(), reqpath, key)
+}
+
+func (keyman *Keyman) getQuota(ctx context.Context, reqpath, key string) (*Quota, error) {
+	redisConn := keyman.redisConnContext(ctx)
+	defer redisConn.Close()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HGET", keyman.rkey("keys"), keyman.keyAddPre(key))
+	redisConn.Send("GET", keyman.rkey(keyman.keyAddPre(key)))
+	redisConn.Send("TTL", keyman.rkey(keyman.keyAddPre(key)))
+	redisConn.Send("HGET", keyman.rkey("limits"), keyman.keyAddPre(key))
+	redisConn.Send("HGET", keyman.rkey("keyorgs"), keyman.keyAddPre(key))
+	redisConn.Send("HGET", keyman.rkey("keypools"), keyman.keyAddPre(key))
+	redisConn.Send("HGET", keyman.rkey("policies"), keyman.keyAddPre(key))
+	redisConn.Send("GET", keyman.rkey(genOverdraftKey(key)))
+	if reqpath != "" {
+		redisConn.Send("GET", keyman.rkey(genCountKey(reqpath, key)))
+		redisConn.Send("GET", keyman.rkey(genTotalCountKey(reqpath, key)))
+	}
+	values, err := redis.Values(redisConn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+
+	q := new(Quota)
+	q.Key = key
+	q.Reqpath = reqpath
+
+	q.Name, err = redis.String(values[0], nil)
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	q.Exist = err == nil
+
+	q.Number, err = redis.Int64(values[1], nil)
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	q.Enabled = err == nil
+
+	q.Sec, err = redis.Int64(values[2], nil)
+	if err != nil {
+		return nil, err
+	}
+	if q.Sec < 0 {
+		q.Sec = 0
+	}
+	q.Expdate = time.Now().Add(time.Duration(q.Sec) * time.Second)
+
+	q.Limit, err = redis.Int64(values[3], nil)
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	q.Org, err = redis.String(values[4], nil)
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	q.Pool, err = redis.String(values[5], nil)
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	policy, err := redis.Bytes(values[6], nil)
+	if err == nil {
+		err = json.Unmarshal(policy, &q.Policy)
+	}
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	q.Overdraft, err = redis.Int64(values[7], nil)
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+
+	if reqpath != "" {
+		q.PathCount, err = redis.Int64(values[8], nil)
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		q.PathTotal, err = redis.Int64(values[9], nil)
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// CheckQuota applies the rules of CheckKey and, for a path quota,
+// CheckPathKeyCount to the values already read. Only keys that belong to
+// an org or have run out and draw from a pool cost further store calls.
+func (keyman *Keyman) CheckQuota(q *Quota) error {
+	return keyman.checkQuota(context.Background(), q)
+}
+
+func (keyman *Keyman) checkQuota(ctx context.Context, q *Quota) error {
+	if !q.Exist {
+		return ErrAccessDenied
+	}
+	if !q.Enabled {
+		return ErrKeyExpired
+	}
+	if q.Number <= 0 {
+		var err error = ErrQuotaExhausted
+		if q.Pool != "" {
+			err = keyman.checkKeyPool(ctx, q.Key)
+		}
+		if err != nil && q.Overdraft < q.Policy.Overdraft {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if q.Reqpath != "" && q.PathCount <= 0 {
+		return ErrQuotaExhausted
+	}
+	if q.Org != "" {
+		err := keyman.checkOrg(ctx, q.Org)
+		if err != nil {
+			return err
+		}
+		if q.Reqpath != "" {
+			return keyman.checkOrgPathCount(ctx, q.Reqpath, q.Org)
+		}
+	}
+	return nil
+}
+
+func (q *Quota) remaining() int64 {
+	if q.Number < 0 {
+		return 0
+	}
+	return q.Number
+}
+
+func (q *Quota) SetHeaders(h http.Header) {
+	h.Set("X-Quota-Remaining", strconv.FormatInt(q.remaining(), 10))
+	h.Set("X-Quota-Reset", strconv.FormatInt(q.Sec, 10))
+	h.Set("X-Quota-Expires", q.Expdate.UTC().Format(time.RFC3339))
+
+	limit, remaining := q.Limit, q.remaining()
+	if q.Reqpath != "" {
+		h.Set("X-Quota-Path-Remaining", strconv.FormatInt(q.PathCount, 10))
+		limit, remaining = q.PathTotal, q.PathCount
+	}
+	if limit > 0 {
+		h.Set("RateLimit-Limit", strconv.FormatInt(limit, 10))
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	h.Set("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+	h.Set("RateLimit-Reset", strconv.FormatInt(q.Sec, 10))
+
+	if q.Number <= 0 && q.Policy.Overdraft > 0 {
+		h.Set("X-Quota-Warning", "overdraft")
+		h.Set("X-Quota-Overdraft-Remaining", strconv.FormatInt(q.Policy.Overdraft-q.Overdraft, 10))
+	} else if q.Policy.Soft > 0 && q.Number <= q.Policy.Soft {
+		h.Set("X-Quota-Warning", "low balance")
+	}
+}
+
+// QuotaHeaders is middleware that validates the key in the request header
+// and reports its quota in the response headers. With byRoute the path
+// quota of the request is validated and reported as well. The values are
+// read before the handler consumes anything.
+func (keyman *Keyman) QuotaHeaders(byRoute bool) gin.HandlerFunc {
+	if byRoute {
+		return keyman.RequirePathQuota(WithQuotaHeaders())
+	}
+	return keyman.RequireKey(WithQuotaHeaders())
+}
@@ -0,0 +1,45 @@
+package keyman
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"time"
+)
+
+// count a call in the current window, the counter expires with it
+var rateScript = redis.NewScript(1, `
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return n
+`)
+
+func genRateKey(path, key string, window int64) string {
+	return path + "-rate-" + key + "-" + strconv.FormatInt(window, 10)
+}
+
+// AllowRate takes one of the limit calls key may make to reqpath in each
+// window. A limit of 0 or less is no limit.
+func (keyman *Keyman) AllowRate(reqpath, key string, limit int, window time.Duration) error {
+	if limit <= 0 {
+		return nil
+	}
+	ms := int64(window / time.Millisecond)
+	if ms <= 0 {
+		ms = 1000
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	n, err := redis.Int(rateScript.Do(redisConn,
+		keyman.rkey(genRateKey(reqpath, key, time.Now().UnixNano()/int64(time.Millisecond)/ms)),
+		ms))
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		return ErrRateLimited
+	}
+	return nil
+}
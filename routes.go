@@ -0,0 +1,149 @@
+package keyman
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"strings"
+)
+
+// DefaultPrefix is where InitHandle mounts the routes.
+const DefaultPrefix = "/keymem"
+
+// RouteSet selects the routes Mount registers. RoutesOwn are called by key
+// holders about their own key, the others take a management key.
+type RouteSet uint
+
+const (
+	RoutesOwn RouteSet = 1 << iota
+	RoutesTokens
+	RoutesKeys
+	RoutesOrgs
+	RoutesPools
+	RoutesPolicies
+	RoutesUsage
+	RoutesAudit
+	RoutesWebhooks
+	RoutesCerts
+	RoutesDiag
+
+	// RoutesKey is what key holders need, RoutesAdmin what managers need,
+	// both revoke tokens.
+	RoutesKey   = RoutesOwn | RoutesTokens
+	RoutesAdmin = RoutesTokens | RoutesKeys | RoutesOrgs | RoutesPools | RoutesPolicies |
+		RoutesUsage | RoutesAudit | RoutesWebhooks | RoutesCerts | RoutesDiag
+	RoutesAll = RoutesKey | RoutesAdmin
+)
+
+var routeSetNames = map[string]RouteSet{
+	"own":      RoutesOwn,
+	"tokens":   RoutesTokens,
+	"keys":     RoutesKeys,
+	"orgs":     RoutesOrgs,
+	"pools":    RoutesPools,
+	"policies": RoutesPolicies,
+	"usage":    RoutesUsage,
+	"audit":    RoutesAudit,
+	"webhooks": RoutesWebhooks,
+	"certs":    RoutesCerts,
+	"diag":     RoutesDiag,
+	"key":      RoutesKey,
+	"admin":    RoutesAdmin,
+	"all":      RoutesAll,
+}
+
+// ParseRoutes reads a comma separated list of route set names, such as
+// "key" or "keys,usage,diag"; "none" or an empty list is no route.
+func ParseRoutes(s string) (RouteSet, error) {
+	var routes RouteSet
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "none" {
+			continue
+		}
+		set, ok := routeSetNames[name]
+		if !ok {
+			return 0, errors.New("unknown routes: " + name)
+		}
+		routes |= set
+	}
+	return routes, nil
+}
+
+// Mount registers the routes of routes on group, e.g. router.Group("/keymem").
+// Each route is registered once, so the sets of a group must not overlap
+// with those of another group of the same router and prefix.
+func (keyman *Keyman) Mount(group gin.IRoutes, routes RouteSet) {
+	if routes&RoutesOwn != 0 {
+		group.GET("/keyaddr", keyman.GetKeyAddr)
+		group.GET("/getownkey", keyman.Getownkey)
+		group.POST("/getcount", keyman.GetCount)
+		group.GET("/getkeyexpdate", keyman.GetKeyExpdate)
+		group.GET("/ownusage", keyman.Getownusage)
+	}
+	if routes&RoutesTokens != 0 {
+		group.POST("/revoketoken", keyman.RevokeToken)
+	}
+
+	if routes&RoutesKeys != 0 {
+		group.POST("/enable", keyman.Enable)
+		group.POST("/addkey", keyman.Addkey)
+		group.POST("/delkey", keyman.Delkey)
+		group.POST("/getkey", keyman.Getkey)
+		group.GET("/listkey", keyman.Listkey)
+		group.POST("/diskey", keyman.Diskey)
+		group.POST("/addcount", keyman.AddCount)
+		group.POST("/addtotalcount", keyman.AddTotalCount)
+		group.POST("/setconcurrent", keyman.SetConcurrent)
+	}
+
+	if routes&RoutesOrgs != 0 {
+		group.POST("/addorg", keyman.Addorg)
+		group.POST("/delorg", keyman.Delorg)
+		group.POST("/enableorg", keyman.EnableOrg)
+		group.POST("/getorg", keyman.Getorg)
+		group.GET("/listorg", keyman.Listorg)
+		group.POST("/setkeyorg", keyman.SetKeyOrg)
+		group.POST("/addorgcount", keyman.AddOrgCount)
+	}
+
+	if routes&RoutesPools != 0 {
+		group.POST("/addpool", keyman.Addpool)
+		group.POST("/delpool", keyman.Delpool)
+		group.POST("/addpoolcount", keyman.AddPoolCount)
+		group.POST("/getpool", keyman.Getpool)
+		group.GET("/listpool", keyman.Listpool)
+		group.POST("/setkeypool", keyman.SetKeyPool)
+		group.POST("/transfer", keyman.Transfer)
+		group.GET("/listtransfer", keyman.ListTransfer)
+	}
+
+	if routes&RoutesPolicies != 0 {
+		group.POST("/setpolicy", keyman.SetPolicy)
+		group.POST("/getpolicy", keyman.Getpolicy)
+		group.POST("/resetoverdraft", keyman.ResetOverdraft)
+	}
+
+	if routes&RoutesUsage != 0 {
+		group.GET("/usage", keyman.Getusage)
+	}
+	if routes&RoutesAudit != 0 {
+		group.GET("/listaudit", keyman.ListAudit)
+	}
+
+	if routes&RoutesWebhooks != 0 {
+		group.POST("/addwebhook", keyman.AddWebhook)
+		group.POST("/delwebhook", keyman.DelWebhook)
+		group.GET("/listwebhook", keyman.ListWebhook)
+		group.GET("/listdelivery", keyman.ListDelivery)
+	}
+
+	if routes&RoutesCerts != 0 {
+		group.POST("/setcertkey", keyman.SetCertKey)
+		group.POST("/delcertkey", keyman.DelCertKey)
+		group.GET("/listcertkey", keyman.ListCertKey)
+	}
+
+	if routes&RoutesDiag != 0 {
+		group.GET("/diag", keyman.Getdiag)
+	}
+}
@@ -0,0 +1,151 @@
+package keyman
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+)
+
+// ended by callers that trace nothing
+var noopSpan = trace.SpanFromContext(context.Background())
+
+func (keyman *Keyman) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if keyman.Tracer == nil {
+		return ctx, noopSpan
+	}
+	return keyman.Tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span of a check that failed with err: a denial is
+// recorded with its reason, anything else as an error of the span.
+func endSpan(span trace.Span, err error) {
+	var e *Error
+	switch {
+	case err == nil:
+		span.SetAttributes(attribute.String("keyman.outcome", "allow"))
+	case errors.As(err, &e):
+		span.SetAttributes(
+			attribute.String("keyman.outcome", "deny"),
+			attribute.String("keyman.reason", e.Message),
+			attribute.String("keyman.code", e.Code))
+	default:
+		span.SetAttributes(attribute.String("keyman.outcome", "error"))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func endDecisionSpan(span trace.Span, d Decision, err error) {
+	if err == nil && !d.Allow {
+		err = d.Err
+	}
+	endSpan(span, err)
+}
+
+// the kind of credentials, never the credentials themselves
+func credentialKind(cred Credentials) string {
+	switch {
+	case cred.Manager:
+		return "manager"
+	case cred.Token != "":
+		return "token"
+	case cred.Signature != "":
+		return "signature"
+	case cred.Key == "" && cred.Cert != nil:
+		return "certificate"
+	default:
+		return "key"
+	}
+}
+
+// tracedConn makes a span of every Do, named after the command. The
+// arguments hold keys and are never recorded, commands queued with Send
+// are listed in db.operation.
+type tracedConn struct {
+	redis.Conn
+	ctx    context.Context
+	tracer trace.Tracer
+	sent   []string
+}
+
+func (c *tracedConn) Send(commandName string, args ...interface{}) error {
+	c.sent = append(c.sent, commandName)
+	return c.Conn.Send(commandName, args...)
+}
+
+func (c *tracedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	ops := c.sent
+	c.sent = nil
+	name := commandName
+	if commandName != "" {
+		ops = append(ops, commandName)
+	} else if len(ops) > 0 {
+		name = "pipeline"
+	} else {
+		return c.Conn.Do(commandName, args...)
+	}
+
+	_, span := c.tracer.Start(c.ctx, "redis "+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "redis"),
+			attribute.String("db.operation", strings.Join(ops, " "))))
+	defer span.End()
+	reply, err := c.Conn.Do(commandName, args...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return reply, err
+}
+
+// a connection from the pool whose commands are traced as part of the span
+// in ctx; without one, for work in the background, they are not
+func (keyman *Keyman) redisConnContext(ctx context.Context) redis.Conn {
+	redisConn := keyman.redisConn()
+	if keyman.Tracer == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+		return redisConn
+	}
+	return &tracedConn{Conn: redisConn, ctx: ctx, tracer: keyman.Tracer}
+}
+
+// TraceRequests is middleware that traces each request in a span, joining
+// the trace of the caller from the headers the propagator set with
+// otel.SetTextMapPropagator reads. Keyman checks made for the request are
+// traced under it.
+func (keyman *Keyman) TraceRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if keyman.Tracer == nil {
+			c.Next()
+			return
+		}
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		ctx, span := keyman.Tracer.Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", route)))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+	}
+}
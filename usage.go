@@ -0,0 +1,265 @@
+package keyman
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	UsageMinute = "minute"
+	UsageHour   = "hour"
+	UsageDay    = "day"
+)
+
+// the most buckets a single query reads
+const maxUsageBuckets = 1500
+
+var usageResolutions = []string{UsageMinute, UsageHour, UsageDay}
+
+// UsageRetention is how long the buckets of each resolution are kept, a
+// zero field keeps the default.
+type UsageRetention struct {
+	Minute time.Duration
+	Hour   time.Duration
+	Day    time.Duration
+}
+
+// UsagePoint is the number of calls in the bucket starting at Time. Route
+// and Status are empty unless the query was grouped by them.
+type UsagePoint struct {
+	Time   int64  `json:"time"`
+	Route  string `json:"route,omitempty"`
+	Status string `json:"status,omitempty"`
+	Count  int64  `json:"count"`
+}
+
+func usageStep(res string) time.Duration {
+	switch res {
+	case UsageMinute:
+		return time.Minute
+	case UsageHour:
+		return time.Hour
+	case UsageDay:
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+func (keyman *Keyman) usageTTL(res string) time.Duration {
+	switch res {
+	case UsageMinute:
+		if keyman.UsageRetention.Minute > 0 {
+			return keyman.UsageRetention.Minute
+		}
+		return 48 * time.Hour
+	case UsageHour:
+		if keyman.UsageRetention.Hour > 0 {
+			return keyman.UsageRetention.Hour
+		}
+		return 45 * 24 * time.Hour
+	default:
+		if keyman.UsageRetention.Day > 0 {
+			return keyman.UsageRetention.Day
+		}
+		return 400 * 24 * time.Hour
+	}
+}
+
+// a hash per key and bucket, fields are "route status"
+func genUsageKey(res, key string, bucket int64) string {
+	return "usage-" + res + "-" + key + "-" + strconv.FormatInt(bucket, 10)
+}
+
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "other"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// RecordUsage counts a call of key to route answered with status in the
+// minute, hour and day buckets of t.
+func (keyman *Keyman) RecordUsage(key, route string, status int, t time.Time) error {
+	field := route + " " + statusClass(status)
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	for _, res := range usageResolutions {
+		step := int64(usageStep(res) / time.Second)
+		bucket := t.Unix() / step * step
+		name := keyman.rkey(genUsageKey(res, key, bucket))
+		redisConn.Send("HINCRBY", name, field, 1)
+		redisConn.Send("EXPIREAT", name, bucket+step+int64(keyman.usageTTL(res)/time.Second))
+	}
+	_, err := redisConn.Do("")
+	return err
+}
+
+// QueryUsage returns the calls of key from from to to at resolution res,
+// summed per bucket and, when group holds "route" or "status", per route
+// or status class.
+func (keyman *Keyman) QueryUsage(key, res string, from, to time.Time, group []string) ([]UsagePoint, error) {
+	step := int64(usageStep(res) / time.Second)
+	if step == 0 {
+		return nil, badRequest("resolution error")
+	}
+	var byRoute, byStatus bool
+	for _, g := range group {
+		switch g {
+		case "route":
+			byRoute = true
+		case "status":
+			byStatus = true
+		case "":
+		default:
+			return nil, badRequest("group error")
+		}
+	}
+	start := from.Unix() / step * step
+	end := to.Unix()
+	if end < start {
+		return nil, badRequest("range error")
+	}
+	if (end-start)/step >= maxUsageBuckets {
+		return nil, badRequest("range too large")
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	var buckets []int64
+	for b := start; b <= end; b += step {
+		buckets = append(buckets, b)
+		redisConn.Send("HGETALL", keyman.rkey(genUsageKey(res, key, b)))
+	}
+	redisConn.Flush()
+
+	var points []UsagePoint
+	for _, b := range buckets {
+		fields, err := redis.Int64Map(redisConn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		sums := make(map[UsagePoint]int64)
+		for field, n := range fields {
+			p := UsagePoint{Time: b}
+			i := strings.LastIndex(field, " ")
+			if byRoute {
+				p.Route = field[:i]
+			}
+			if byStatus {
+				p.Status = field[i+1:]
+			}
+			sums[p] += n
+		}
+		var bucketPoints []UsagePoint
+		for p, n := range sums {
+			p.Count = n
+			bucketPoints = append(bucketPoints, p)
+		}
+		sort.Slice(bucketPoints, func(i, j int) bool {
+			if bucketPoints[i].Route != bucketPoints[j].Route {
+				return bucketPoints[i].Route < bucketPoints[j].Route
+			}
+			return bucketPoints[i].Status < bucketPoints[j].Status
+		})
+		points = append(points, bucketPoints...)
+	}
+	return points, nil
+}
+
+// UsageRecorder is middleware that records the usage of the identity set
+// by a Require middleware before it, by route template and status.
+func (keyman *Keyman) UsageRecorder() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		id, ok := GetIdentity(c)
+		if !ok || id.Manager {
+			return
+		}
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		keyman.RecordUsage(id.Key, route, c.Writer.Status(), time.Now())
+	}
+}
+
+func parseUsageQuery(c *gin.Context) (string, time.Time, time.Time, []string, error) {
+	res := c.DefaultQuery("res", UsageHour)
+	to := time.Now()
+	if s := c.Query("to"); s != "" {
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return "", to, to, nil, badRequest("to error")
+		}
+		to = time.Unix(sec, 0)
+	}
+	from := to.Add(-24 * time.Hour)
+	if s := c.Query("from"); s != "" {
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return "", from, to, nil, badRequest("from error")
+		}
+		from = time.Unix(sec, 0)
+	}
+	var group []string
+	if s := c.Query("group"); s != "" {
+		group = strings.Split(s, ",")
+	}
+	return res, from, to, group, nil
+}
+
+func (keyman *Keyman) renderUsage(c *gin.Context, key string) {
+	res, from, to, group, err := parseUsageQuery(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	points, err := keyman.QueryUsage(key, res, from, to, group)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"res":    res,
+		"from":   from.Unix(),
+		"to":     to.Unix(),
+		"usage":  points,
+	})
+}
+
+// Getusage returns the usage of any key to a manager.
+func (keyman *Keyman) Getusage(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	key := c.Query("usagekey")
+	if strings.EqualFold("", key) {
+		keyman.renderError(c, badRequest("require usagekey"))
+		return
+	}
+	keyman.renderUsage(c, key)
+}
+
+// Getownusage returns the usage of the key in the header to its holder.
+func (keyman *Keyman) Getownusage(c *gin.Context) {
+	if !keyman.IsKeyValidOnlytime(c) {
+		return
+	}
+	keyman.renderUsage(c, c.GetHeader("key"))
+}
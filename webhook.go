@@ -0,0 +1,486 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWebhookRetries = 5
+	defaultWebhookDeadLen = 1000
+	webhookBackoff        = time.Second
+	webhookQueueSize      = 1000
+	maxDeliveries         = 1000
+)
+
+// Webhook receives the events listed in Events, all of them when empty,
+// as a POST signed with Secret, see SignWebhook.
+type Webhook struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url" binding:"required"`
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events"`
+}
+
+func (w *Webhook) wants(typ string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the body of a delivery. KeyID is the address of the
+// key, the key itself is never sent.
+type WebhookPayload struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	KeyID  string `json:"key_id,omitempty"`
+	Target string `json:"target,omitempty"`
+	Route  string `json:"route,omitempty"`
+	Value  int64  `json:"value"`
+	Time   int64  `json:"time"`
+}
+
+// Delivery is the outcome of sending a payload to a webhook. Status is
+// "ok", or "dead" once every attempt failed.
+type Delivery struct {
+	ID       string          `json:"id"`
+	Webhook  string          `json:"webhook"`
+	Event    string          `json:"event"`
+	Status   string          `json:"status"`
+	Attempts int             `json:"attempts"`
+	Code     int             `json:"code,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Time     int64           `json:"time"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+}
+
+type webhookJob struct {
+	webhook  *Webhook
+	payload  []byte
+	delivery *Delivery
+}
+
+// SignWebhook returns the X-Keymem-Signature of body sent at timestamp,
+// receivers compute it with their secret to check a delivery.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (keyman *Keyman) webhookRetries() int {
+	if keyman.WebhookRetries <= 0 {
+		return defaultWebhookRetries
+	}
+	return keyman.WebhookRetries
+}
+
+func (keyman *Keyman) webhookDeadLen() int64 {
+	if keyman.WebhookDeadLen <= 0 {
+		return defaultWebhookDeadLen
+	}
+	return keyman.WebhookDeadLen
+}
+
+func (keyman *Keyman) GetWebhooks() ([]*Webhook, error) {
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	values, err := redis.StringMap(redisConn.Do("HGETALL", keyman.rkey("webhooks")))
+	if err != nil {
+		return nil, err
+	}
+	var webhooks []*Webhook
+	for _, v := range values {
+		w := new(Webhook)
+		err = json.Unmarshal([]byte(v), w)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, nil
+}
+
+// StartWebhooks delivers the events Keyman emits to the configured
+// webhooks with workers goroutines, until stop is called. stop waits for
+// the events emitted before it and the deliveries queued, each tried once
+// more; deliveries waiting to be retried end in the dead letters.
+func (keyman *Keyman) StartWebhooks(workers int) (stop func()) {
+	queue := make(chan *webhookJob, webhookQueueSize)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var once sync.Once
+
+	// events being dispatched and deliveries waiting for a retry
+	var mu sync.Mutex
+	var stopping bool
+	var dispatching sync.WaitGroup
+	retries := make(map[*webhookJob]*time.Timer)
+
+	// requeue without blocking, a full queue or a stopped dispatcher ends
+	// the delivery in the dead letters
+	enqueue := func(job *webhookJob) {
+		select {
+		case <-done:
+			job.delivery.Error = "dispatcher stopped"
+			keyman.finishDelivery(job, false)
+		case queue <- job:
+		default:
+			job.delivery.Error = "queue full"
+			go keyman.finishDelivery(job, false)
+		}
+	}
+	retry := func(job *webhookJob, backoff time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		retries[job] = time.AfterFunc(backoff, func() {
+			mu.Lock()
+			delete(retries, job)
+			mu.Unlock()
+			enqueue(job)
+		})
+	}
+
+	unsubscribe := keyman.Subscribe(func(ev Event) {
+		mu.Lock()
+		counted := !stopping
+		if counted {
+			dispatching.Add(1)
+		}
+		mu.Unlock()
+		go func() {
+			keyman.dispatchEvent(ev, enqueue)
+			if counted {
+				dispatching.Done()
+			}
+		}()
+	})
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					for {
+						select {
+						case job := <-queue:
+							keyman.finishDelivery(job, keyman.deliver(client, job))
+						default:
+							return
+						}
+					}
+				case job := <-queue:
+					if keyman.deliver(client, job) {
+						keyman.finishDelivery(job, true)
+						continue
+					}
+					if job.delivery.Attempts >= keyman.webhookRetries() {
+						keyman.finishDelivery(job, false)
+						continue
+					}
+					retry(job, webhookBackoff<<uint(job.delivery.Attempts-1))
+				}
+			}
+		}()
+	}
+
+	return func() {
+		once.Do(func() {
+			unsubscribe()
+			mu.Lock()
+			stopping = true
+			mu.Unlock()
+			dispatching.Wait()
+			close(done)
+			wg.Wait()
+
+			mu.Lock()
+			defer mu.Unlock()
+			for job, t := range retries {
+				if t.Stop() {
+					job.delivery.Error = "dispatcher stopped"
+					keyman.finishDelivery(job, false)
+				}
+			}
+		})
+	}
+}
+
+func (keyman *Keyman) dispatchEvent(ev Event, enqueue func(job *webhookJob)) {
+	webhooks, err := keyman.GetWebhooks()
+	if err != nil {
+		return
+	}
+	payload := WebhookPayload{
+		ID:     genLeaseID(),
+		Type:   ev.Type,
+		Target: ev.Target,
+		Route:  ev.Route,
+		Value:  ev.Value,
+		Time:   ev.Time.Unix(),
+	}
+	if ev.Key != "" {
+		payload.KeyID = KeyToAddrStr(ev.Key)
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	for _, w := range webhooks {
+		if !w.wants(ev.Type) {
+			continue
+		}
+		enqueue(&webhookJob{
+			webhook: w,
+			payload: b,
+			delivery: &Delivery{
+				ID:      payload.ID,
+				Webhook: w.ID,
+				Event:   ev.Type,
+			},
+		})
+	}
+}
+
+func (keyman *Keyman) deliver(client *http.Client, job *webhookJob) bool {
+	job.delivery.Attempts++
+	req, err := http.NewRequest("POST", job.webhook.URL, bytes.NewReader(job.payload))
+	if err != nil {
+		job.delivery.Error = err.Error()
+		return false
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Keymem-Event", job.delivery.Event)
+	req.Header.Set("X-Keymem-Delivery", job.delivery.ID)
+	req.Header.Set("X-Keymem-Timestamp", timestamp)
+	req.Header.Set("X-Keymem-Signature", SignWebhook(job.webhook.Secret, timestamp, job.payload))
+
+	res, err := client.Do(req)
+	if err != nil {
+		job.delivery.Error = err.Error()
+		return false
+	}
+	res.Body.Close()
+	job.delivery.Code = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		job.delivery.Error = res.Status
+		return false
+	}
+	job.delivery.Error = ""
+	return true
+}
+
+// record the outcome in "webhookdeliveries", a failed delivery is kept with
+// its payload in "webhookdead", both trimmed to the latest ones
+func (keyman *Keyman) finishDelivery(job *webhookJob, ok bool) {
+	d := job.delivery
+	d.Time = time.Now().Unix()
+	d.Status = "ok"
+	if !ok {
+		d.Status = "dead"
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	redisConn.Send("LPUSH", keyman.rkey("webhookdeliveries"), b)
+	redisConn.Send("LTRIM", keyman.rkey("webhookdeliveries"), 0, maxDeliveries-1)
+	if !ok {
+		d.Payload = job.payload
+		dead, err := json.Marshal(d)
+		if err == nil {
+			redisConn.Send("LPUSH", keyman.rkey("webhookdead"), dead)
+			redisConn.Send("LTRIM", keyman.rkey("webhookdead"), 0, keyman.webhookDeadLen()-1)
+		}
+	}
+	redisConn.Do("")
+}
+
+func (keyman *Keyman) AddWebhook(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	var w Webhook
+	err = c.BindJSON(&w)
+	if err != nil {
+		keyman.renderError(c, badRequest(err.Error()))
+		return
+	}
+	if !strings.HasPrefix(w.URL, "http://") && !strings.HasPrefix(w.URL, "https://") {
+		keyman.renderError(c, badRequest("url error"))
+		return
+	}
+	if w.ID == "" {
+		w.ID = genLeaseID()[:16]
+	}
+
+	b, err := json.Marshal(w)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	redisConn.Send("MULTI")
+	redisConn.Send("HSET", keyman.rkey("webhooks"), w.ID, b)
+	err = keyman.execAudited(redisConn, c, priv, "addwebhook", w.ID, nil, gin.H{"url": w.URL, "events": w.Events})
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"id":     w.ID,
+	})
+}
+
+func (keyman *Keyman) DelWebhook(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	id := c.Request.FormValue("id")
+	if strings.EqualFold("", id) {
+		keyman.renderError(c, badRequest("require id"))
+		return
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	isExist, err := redis.Int(redisConn.Do("HEXISTS", keyman.rkey("webhooks"), id))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if isExist == 0 {
+		keyman.renderError(c, &Error{"WEBHOOK_NOT_FOUND", http.StatusNotFound, "webhook not exist"})
+		return
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HDEL", keyman.rkey("webhooks"), id)
+	err = keyman.execAudited(redisConn, c, priv, "delwebhook", id, nil, nil)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"id":     id,
+	})
+}
+
+func (keyman *Keyman) ListWebhook(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	webhooks, err := keyman.GetWebhooks()
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	for _, w := range webhooks {
+		w.Secret = ""
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "ok",
+		"webhooks": webhooks,
+	})
+}
+
+// ListDelivery lists the latest deliveries, or with dead=1 the dead
+// letters with their payload.
+func (keyman *Keyman) ListDelivery(c *gin.Context) {
+	priv, err := keyman.GetManPriv(c)
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	if priv == nil {
+		keyman.renderError(c, ErrAccessDenied)
+		return
+	}
+
+	list := "webhookdeliveries"
+	if c.Query("dead") == "1" {
+		list = "webhookdead"
+	}
+	count, err := strconv.Atoi(c.DefaultQuery("count", "100"))
+	if err != nil || count <= 0 {
+		keyman.renderError(c, badRequest("count error"))
+		return
+	}
+	if count > maxListCount {
+		count = maxListCount
+	}
+
+	redisConn := keyman.redisConn()
+	defer redisConn.Close()
+	values, err := redis.ByteSlices(redisConn.Do("LRANGE", keyman.rkey(list), 0, count-1))
+	if err != nil {
+		keyman.renderError(c, err)
+		return
+	}
+	deliveries := make([]*Delivery, 0, len(values))
+	for _, v := range values {
+		d := new(Delivery)
+		err = json.Unmarshal(v, d)
+		if err != nil {
+			keyman.renderError(c, err)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "ok",
+		"deliveries": deliveries,
+	})
+}